@@ -0,0 +1,193 @@
+// Package activitypub exposes the tweets table as a single ActivityPub
+// actor, so Fediverse accounts on Mastodon, honk, jsonpub and the like can
+// discover, follow, and receive tweets from this archive as they're
+// imported, the same actor/outbox pattern those projects use themselves.
+package activitypub
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"database/sql"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+)
+
+// Server is the ActivityPub actor backed by a tweetarchive database. There
+// is exactly one actor per archive.
+type Server struct {
+	db       *sql.DB
+	baseURL  string
+	username string
+	actor    *actorRecord
+}
+
+// New loads or creates the archive's actor and returns a Server ready to
+// have its handlers registered and its delivery queue started.
+func New(db *sql.DB, baseURL, username string) (*Server, error) {
+	s := &Server{db: db, baseURL: baseURL, username: username}
+	if err := s.ensureSchema(); err != nil {
+		return nil, err
+	}
+	actor, err := s.loadOrCreateActor()
+	if err != nil {
+		return nil, err
+	}
+	s.actor = actor
+	return s, nil
+}
+
+// Start begins polling the delivery queue in the background. Callers
+// should cancel ctx to stop it.
+func (s *Server) Start(ctx context.Context) {
+	go s.runDeliveryQueue(ctx)
+}
+
+// RegisterHandlers wires the webfinger, actor, outbox, inbox and tweet
+// permalink endpoints into mux.
+func (s *Server) RegisterHandlers(mux *http.ServeMux) {
+	mux.HandleFunc("/.well-known/webfinger", s.WebfingerHandler)
+	mux.HandleFunc("/actor", s.ActorHandler)
+	mux.HandleFunc("/outbox", s.OutboxHandler)
+	mux.HandleFunc("/inbox", s.InboxHandler)
+	mux.HandleFunc("/tweet/", s.TweetHandler)
+}
+
+func (s *Server) actorURL() string {
+	return s.baseURL + "/actor"
+}
+
+func (s *Server) tweetURL(id string) string {
+	return fmt.Sprintf("%s/tweet/%s", s.baseURL, id)
+}
+
+const schemaSql = `
+create table actors (
+	id serial primary key,
+	username text not null unique,
+	private_key bytea not null,
+	public_key bytea not null,
+	last_announced_id bigint not null default 0,
+	created_at timestamp not null default now()
+);
+
+create table followers (
+	id serial primary key,
+	actor_id integer references actors(id),
+	inbox_url text not null,
+	created_at timestamp not null default now(),
+	unique (actor_id, inbox_url)
+);
+
+create table deliveries (
+	id serial primary key,
+	follower_id integer references followers(id),
+	inbox_url text not null,
+	activity json not null,
+	attempts integer not null default 0,
+	next_attempt_at timestamp not null default now(),
+	delivered boolean not null default false,
+	last_error text
+);
+
+create index on deliveries (delivered, next_attempt_at);
+`
+
+func (s *Server) tableExists(name string) bool {
+	row := s.db.QueryRow("select true from pg_tables where tablename = $1", name)
+	var found bool
+	return row.Scan(&found) == nil
+}
+
+func (s *Server) ensureSchema() error {
+	if s.tableExists("actors") {
+		return nil
+	}
+	_, err := s.db.Exec(schemaSql)
+	return err
+}
+
+// actorRecord is the local actor's persisted identity: its keypair and the
+// high-water mark of tweets already announced to followers.
+type actorRecord struct {
+	id              int64
+	username        string
+	privateKey      *rsa.PrivateKey
+	publicKey       *rsa.PublicKey
+	lastAnnouncedID int64
+}
+
+func (s *Server) loadOrCreateActor() (*actorRecord, error) {
+	row := s.db.QueryRow(
+		`select id, private_key, public_key, last_announced_id from actors where username = $1`,
+		s.username)
+	var (
+		id              int64
+		privPEM, pubPEM []byte
+		lastAnnouncedID int64
+	)
+	err := row.Scan(&id, &privPEM, &pubPEM, &lastAnnouncedID)
+	if err == sql.ErrNoRows {
+		return s.createActor()
+	}
+	if err != nil {
+		return nil, err
+	}
+	priv, err := decodePrivateKeyPEM(privPEM)
+	if err != nil {
+		return nil, err
+	}
+	return &actorRecord{
+		id:              id,
+		username:        s.username,
+		privateKey:      priv,
+		publicKey:       &priv.PublicKey,
+		lastAnnouncedID: lastAnnouncedID,
+	}, nil
+}
+
+func (s *Server) createActor() (*actorRecord, error) {
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, err
+	}
+	privPEM := encodePrivateKeyPEM(priv)
+	pubPEM, err := encodePublicKeyPEM(&priv.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	var id int64
+	err = s.db.QueryRow(
+		`insert into actors (username, private_key, public_key) values ($1, $2, $3) returning id`,
+		s.username, privPEM, pubPEM,
+	).Scan(&id)
+	if err != nil {
+		return nil, err
+	}
+	return &actorRecord{id: id, username: s.username, privateKey: priv, publicKey: &priv.PublicKey}, nil
+}
+
+func encodePrivateKeyPEM(priv *rsa.PrivateKey) []byte {
+	return pem.EncodeToMemory(&pem.Block{
+		Type:  "RSA PRIVATE KEY",
+		Bytes: x509.MarshalPKCS1PrivateKey(priv),
+	})
+}
+
+func decodePrivateKeyPEM(b []byte) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, fmt.Errorf("activitypub: invalid private key PEM")
+	}
+	return x509.ParsePKCS1PrivateKey(block.Bytes)
+}
+
+func encodePublicKeyPEM(pub *rsa.PublicKey) ([]byte, error) {
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), nil
+}
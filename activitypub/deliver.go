@@ -0,0 +1,208 @@
+package activitypub
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// enqueueDelivery queues activity for delivery to a follower's inbox. The
+// actual HTTP delivery, and its retries, happen in runDeliveryQueue.
+func (s *Server) enqueueDelivery(ctx context.Context, followerID int64, inboxURL string, activity interface{}) error {
+	payload, err := json.Marshal(activity)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.ExecContext(ctx,
+		`insert into deliveries (follower_id, inbox_url, activity) values ($1, $2, $3)`,
+		followerID, inboxURL, string(payload))
+	return err
+}
+
+// FanOutNew queues a Create{Note} delivery, to every current follower, for
+// every tweet whose id is above the highest id announced so far (the
+// actor's last_announced_id). A tweet inserted later with a lower id, such
+// as one from an older archive or with a hashed synthetic id, is not
+// announced. It's called after each import job finishes. Newly-followed accounts only receive tweets
+// imported from that point on; the outbox covers backfill.
+func (s *Server) FanOutNew(ctx context.Context) (int, error) {
+	followerRows, err := s.db.QueryContext(ctx,
+		`select id, inbox_url from followers where actor_id = $1`, s.actor.id)
+	if err != nil {
+		return 0, err
+	}
+	type follower struct {
+		id    int64
+		inbox string
+	}
+	var followers []follower
+	for followerRows.Next() {
+		var f follower
+		if err := followerRows.Scan(&f.id, &f.inbox); err != nil {
+			followerRows.Close()
+			return 0, err
+		}
+		followers = append(followers, f)
+	}
+	followerRows.Close()
+
+	tweetRows, err := s.db.QueryContext(ctx,
+		`select id, text, created_at, array_to_string(hashtags, ','), array_to_string(user_mentions, ',')
+		 from tweets where id > $1 order by id`,
+		s.actor.lastAnnouncedID)
+	if err != nil {
+		return 0, err
+	}
+	defer tweetRows.Close()
+
+	count := 0
+	maxID := s.actor.lastAnnouncedID
+	for tweetRows.Next() {
+		var id int64
+		var text, hashtagsCSV, mentionsCSV string
+		var createdAt time.Time
+		if err := tweetRows.Scan(&id, &text, &createdAt, &hashtagsCSV, &mentionsCSV); err != nil {
+			return count, err
+		}
+		count++
+		if id > maxID {
+			maxID = id
+		}
+		if len(followers) == 0 {
+			continue
+		}
+		idStr := fmt.Sprintf("%d", id)
+		note := s.renderNote(idStr, text, createdAt, splitCSV(hashtagsCSV), splitCSV(mentionsCSV))
+		create := s.renderCreate(note)
+		for _, f := range followers {
+			if err := s.enqueueDelivery(ctx, f.id, f.inbox, create); err != nil {
+				return count, err
+			}
+		}
+	}
+	if maxID > s.actor.lastAnnouncedID {
+		if _, err := s.db.ExecContext(ctx,
+			`update actors set last_announced_id = $1 where id = $2`, maxID, s.actor.id); err != nil {
+			return count, err
+		}
+		s.actor.lastAnnouncedID = maxID
+	}
+	return count, nil
+}
+
+const deliveryPollInterval = 5 * time.Second
+const deliveryBatchSize = 50
+const maxDeliveryBackoff = 6 * time.Hour
+
+// runDeliveryQueue polls the deliveries table and attempts to deliver
+// whatever is due, backing off exponentially per-activity on failure. It
+// runs until ctx is canceled.
+func (s *Server) runDeliveryQueue(ctx context.Context) {
+	ticker := time.NewTicker(deliveryPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := s.deliverPending(ctx); err != nil {
+				log.Println("activitypub: delivery queue:", err)
+			}
+		}
+	}
+}
+
+func (s *Server) deliverPending(ctx context.Context) error {
+	rows, err := s.db.QueryContext(ctx,
+		`select id, inbox_url, activity, attempts from deliveries
+		 where not delivered and next_attempt_at <= now() order by id limit $1`,
+		deliveryBatchSize)
+	if err != nil {
+		return err
+	}
+	type job struct {
+		id       int64
+		inboxURL string
+		activity []byte
+		attempts int
+	}
+	var jobs []job
+	for rows.Next() {
+		var j job
+		if err := rows.Scan(&j.id, &j.inboxURL, &j.activity, &j.attempts); err != nil {
+			rows.Close()
+			return err
+		}
+		jobs = append(jobs, j)
+	}
+	rows.Close()
+
+	for _, j := range jobs {
+		if err := s.deliver(ctx, j.inboxURL, j.activity); err != nil {
+			backoff := time.Duration(1<<uint(j.attempts)) * time.Minute
+			if backoff > maxDeliveryBackoff {
+				backoff = maxDeliveryBackoff
+			}
+			s.db.ExecContext(ctx,
+				`update deliveries set attempts = attempts + 1,
+				 next_attempt_at = now() + ($2 * interval '1 second'), last_error = $3
+				 where id = $1`,
+				j.id, backoff.Seconds(), err.Error())
+			continue
+		}
+		s.db.ExecContext(ctx, `update deliveries set delivered = true where id = $1`, j.id)
+	}
+	return nil
+}
+
+func (s *Server) deliver(ctx context.Context, inboxURL string, activity []byte) error {
+	req, err := http.NewRequestWithContext(ctx, "POST", inboxURL, bytes.NewReader(activity))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/activity+json")
+	if err := s.signRequest(req, activity); err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("activitypub: delivery to %s failed: %s", inboxURL, resp.Status)
+	}
+	return nil
+}
+
+// signRequest adds Digest, Date and Signature headers per the HTTP
+// Signatures draft Mastodon, honk and jsonpub all speak, so followers can
+// authenticate deliveries as coming from this actor.
+func (s *Server) signRequest(req *http.Request, body []byte) error {
+	digest := sha256.Sum256(body)
+	req.Header.Set("Digest", "SHA-256="+base64.StdEncoding.EncodeToString(digest[:]))
+	req.Header.Set("Date", time.Now().UTC().Format(http.TimeFormat))
+	req.Header.Set("Host", req.URL.Host)
+
+	signedHeaders := []string{"(request-target)", "host", "date", "digest"}
+	signingString := buildSigningString(signedHeaders, req)
+	hashed := sha256.Sum256([]byte(signingString))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, s.actor.privateKey, crypto.SHA256, hashed[:])
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Signature", fmt.Sprintf(
+		`keyId="%s",algorithm="rsa-sha256",headers="%s",signature="%s"`,
+		s.actorURL()+"#main-key", strings.Join(signedHeaders, " "), base64.StdEncoding.EncodeToString(sig)))
+	return nil
+}
@@ -0,0 +1,224 @@
+package activitypub
+
+import (
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/textproto"
+	"strings"
+)
+
+const maxInboxBodyBytes = 1 << 20
+
+// InboxHandler serves /inbox, accepting Follow activities (and logging,
+// but otherwise ignoring, anything else).
+func (s *Server) InboxHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", 405)
+		return
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxInboxBodyBytes))
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	var act incomingActivity
+	if err := json.Unmarshal(body, &act); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	signer, signerURL, err := s.verifySignature(r, body)
+	if err != nil {
+		http.Error(w, "signature verification failed: "+err.Error(), 401)
+		return
+	}
+	switch act.Type {
+	case "Follow":
+		if err := s.handleFollow(r.Context(), act, signerURL, signer); err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+	default:
+		log.Printf("activitypub: ignoring unsupported inbox activity %q from %s", act.Type, act.Actor)
+	}
+	w.WriteHeader(202)
+}
+
+type incomingActivity struct {
+	Type   string          `json:"type"`
+	Actor  string          `json:"actor"`
+	ID     string          `json:"id"`
+	Object json.RawMessage `json:"object"`
+}
+
+// handleFollow registers a follower from a Follow activity, after checking
+// that its envelope actor is the same identity that signed the request —
+// otherwise a client could sign with its own key but name any third party
+// as "actor" and have us register (and deliver future posts to) that third
+// party's real inbox instead of its own.
+func (s *Server) handleFollow(ctx context.Context, act incomingActivity, signerURL string, remote *remoteActor) error {
+	if act.Actor != signerURL {
+		return fmt.Errorf("activitypub: Follow actor %q does not match the signing key's actor %q", act.Actor, signerURL)
+	}
+	var followerID int64
+	err := s.db.QueryRowContext(ctx,
+		`insert into followers (actor_id, inbox_url) values ($1, $2)
+		 on conflict (actor_id, inbox_url) do update set inbox_url = excluded.inbox_url
+		 returning id`,
+		s.actor.id, remote.Inbox,
+	).Scan(&followerID)
+	if err != nil {
+		return err
+	}
+	accept := map[string]interface{}{
+		"@context": "https://www.w3.org/ns/activitystreams",
+		"id":       act.ID + "/accept",
+		"type":     "Accept",
+		"actor":    s.actorURL(),
+		"object":   act,
+	}
+	return s.enqueueDelivery(ctx, followerID, remote.Inbox, accept)
+}
+
+type remoteActor struct {
+	Inbox     string `json:"inbox"`
+	PublicKey struct {
+		PublicKeyPem string `json:"publicKeyPem"`
+	} `json:"publicKey"`
+}
+
+func fetchActor(ctx context.Context, actorURL string) (*remoteActor, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", actorURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/activity+json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("activitypub: fetching actor %s: %s", actorURL, resp.Status)
+	}
+	var ra remoteActor
+	if err := json.NewDecoder(resp.Body).Decode(&ra); err != nil {
+		return nil, err
+	}
+	return &ra, nil
+}
+
+// verifySignature checks the inbound request's HTTP Signature (as used by
+// Mastodon, honk and jsonpub) against the public key of the actor named in
+// its keyId, and returns that actor (and its URL, with any keyId fragment
+// stripped) so callers can check the activity body's own claimed actor
+// against the identity that actually signed the request.
+func (s *Server) verifySignature(r *http.Request, body []byte) (*remoteActor, string, error) {
+	params := parseSignatureHeader(r.Header.Get("Signature"))
+	keyID := params["keyId"]
+	if keyID == "" {
+		return nil, "", fmt.Errorf("missing Signature keyId")
+	}
+	sig, err := base64.StdEncoding.DecodeString(params["signature"])
+	if err != nil {
+		return nil, "", fmt.Errorf("invalid signature encoding: %w", err)
+	}
+	headerNames := strings.Fields(params["headers"])
+	if err := verifyDigest(headerNames, r.Header.Get("Digest"), body); err != nil {
+		return nil, "", err
+	}
+	actorURL := strings.SplitN(keyID, "#", 2)[0]
+	remote, err := fetchActor(r.Context(), actorURL)
+	if err != nil {
+		return nil, "", err
+	}
+	block, _ := pem.Decode([]byte(remote.PublicKey.PublicKeyPem))
+	if block == nil {
+		return nil, "", fmt.Errorf("remote actor has no usable public key")
+	}
+	pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, "", err
+	}
+	rsaPub, ok := pub.(*rsa.PublicKey)
+	if !ok {
+		return nil, "", fmt.Errorf("unsupported remote public key type %T", pub)
+	}
+	signingString := buildSigningString(headerNames, r)
+	hashed := sha256.Sum256([]byte(signingString))
+	if err := rsa.VerifyPKCS1v15(rsaPub, crypto.SHA256, hashed[:], sig); err != nil {
+		return nil, "", err
+	}
+	return remote, actorURL, nil
+}
+
+// verifyDigest confirms that the request's Digest header, which the
+// Signature's covered headers claim to include, actually matches body. The
+// signing string is built from the *claimed* Digest header value, not the
+// body itself, so without this check an intermediary could swap the body
+// (and its Digest header) for different content entirely and still pass
+// signature verification, so long as the signature was computed over the
+// substituted header.
+func verifyDigest(headerNames []string, digestHeader string, body []byte) error {
+	covered := false
+	for _, h := range headerNames {
+		if strings.EqualFold(h, "digest") {
+			covered = true
+			break
+		}
+	}
+	if !covered {
+		return fmt.Errorf("Signature does not cover the Digest header")
+	}
+	parts := strings.SplitN(digestHeader, "=", 2)
+	if len(parts) != 2 || !strings.EqualFold(parts[0], "SHA-256") {
+		return fmt.Errorf("unsupported or missing Digest header %q", digestHeader)
+	}
+	want := parts[1]
+	sum := sha256.Sum256(body)
+	got := base64.StdEncoding.EncodeToString(sum[:])
+	if subtle.ConstantTimeCompare([]byte(got), []byte(want)) != 1 {
+		return fmt.Errorf("Digest header does not match request body")
+	}
+	return nil
+}
+
+func buildSigningString(headerNames []string, r *http.Request) string {
+	var lines []string
+	for _, h := range headerNames {
+		if h == "(request-target)" {
+			lines = append(lines, fmt.Sprintf("(request-target): %s %s", strings.ToLower(r.Method), r.URL.RequestURI()))
+			continue
+		}
+		if strings.EqualFold(h, "host") && r.Header.Get("Host") == "" {
+			// net/http moves an incoming request's Host header into r.Host.
+			lines = append(lines, fmt.Sprintf("%s: %s", h, r.Host))
+			continue
+		}
+		lines = append(lines, fmt.Sprintf("%s: %s", h, r.Header.Get(textproto.CanonicalMIMEHeaderKey(h))))
+	}
+	return strings.Join(lines, "\n")
+}
+
+func parseSignatureHeader(h string) map[string]string {
+	params := make(map[string]string)
+	for _, part := range strings.Split(h, ",") {
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		params[strings.TrimSpace(kv[0])] = strings.Trim(kv[1], `"`)
+	}
+	return params
+}
@@ -0,0 +1,128 @@
+package activitypub
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestVerifyDigest(t *testing.T) {
+	body := []byte(`{"type":"Follow"}`)
+	sum := sha256.Sum256(body)
+	digest := "SHA-256=" + base64.StdEncoding.EncodeToString(sum[:])
+
+	if err := verifyDigest([]string{"(request-target)", "host", "digest"}, digest, body); err != nil {
+		t.Fatalf("verifyDigest with matching digest: %v", err)
+	}
+
+	if err := verifyDigest([]string{"(request-target)", "host"}, digest, body); err == nil {
+		t.Fatal("verifyDigest should reject a Signature that doesn't cover Digest")
+	}
+
+	tampered := append(append([]byte{}, body...), '!')
+	if err := verifyDigest([]string{"digest"}, digest, tampered); err == nil {
+		t.Fatal("verifyDigest should reject a body that doesn't match the Digest header")
+	}
+
+	if err := verifyDigest([]string{"digest"}, "MD5=bogus", body); err == nil {
+		t.Fatal("verifyDigest should reject a non-SHA-256 Digest header")
+	}
+}
+
+// signedRequest builds a POST /inbox request signed the way Mastodon/honk
+// sign theirs: Digest covers the body, and the Signature covers
+// (request-target), host and digest.
+func signedRequest(t *testing.T, priv *rsa.PrivateKey, keyID string, body []byte) *http.Request {
+	t.Helper()
+	sum := sha256.Sum256(body)
+	digest := "SHA-256=" + base64.StdEncoding.EncodeToString(sum[:])
+
+	req := httptest.NewRequest("POST", "/inbox", bytes.NewReader(body))
+	req.Header.Set("Host", "archive.example")
+	req.Header.Set("Digest", digest)
+
+	signingString := fmt.Sprintf("(request-target): post /inbox\nhost: %s\ndigest: %s",
+		req.Header.Get("Host"), digest)
+	hashed := sha256.Sum256([]byte(signingString))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, priv, crypto.SHA256, hashed[:])
+	if err != nil {
+		t.Fatalf("SignPKCS1v15: %v", err)
+	}
+	req.Header.Set("Signature", fmt.Sprintf(
+		`keyId="%s",algorithm="rsa-sha256",headers="(request-target) host digest",signature="%s"`,
+		keyID, base64.StdEncoding.EncodeToString(sig)))
+	return req
+}
+
+func TestVerifySignature(t *testing.T) {
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+	pubBytes, err := x509.MarshalPKIXPublicKey(&priv.PublicKey)
+	if err != nil {
+		t.Fatalf("MarshalPKIXPublicKey: %v", err)
+	}
+	pubPEM := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pubBytes})
+
+	actorServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/activity+json")
+		fmt.Fprintf(w, `{"inbox":"https://remote.example/inbox","publicKey":{"publicKeyPem":%q}}`, pubPEM)
+	}))
+	defer actorServer.Close()
+
+	actorURL := actorServer.URL + "/actor"
+	keyID := actorURL + "#main-key"
+	body := []byte(`{"type":"Follow","actor":"` + actorURL + `"}`)
+
+	s := &Server{}
+
+	t.Run("valid signature", func(t *testing.T) {
+		req := signedRequest(t, priv, keyID, body)
+		remote, gotActorURL, err := s.verifySignature(req, body)
+		if err != nil {
+			t.Fatalf("verifySignature: %v", err)
+		}
+		if gotActorURL != actorURL {
+			t.Errorf("actorURL = %q, want %q", gotActorURL, actorURL)
+		}
+		if remote.Inbox != "https://remote.example/inbox" {
+			t.Errorf("remote.Inbox = %q, want the fetched actor's inbox", remote.Inbox)
+		}
+	})
+
+	t.Run("tampered body", func(t *testing.T) {
+		req := signedRequest(t, priv, keyID, body)
+		if _, _, err := s.verifySignature(req, append(append([]byte{}, body...), '!')); err == nil {
+			t.Fatal("verifySignature should reject a body that doesn't match the signed Digest")
+		}
+	})
+
+	t.Run("wrong key", func(t *testing.T) {
+		otherPriv, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			t.Fatalf("GenerateKey: %v", err)
+		}
+		req := signedRequest(t, otherPriv, keyID, body)
+		if _, _, err := s.verifySignature(req, body); err == nil {
+			t.Fatal("verifySignature should reject a signature made with the wrong key")
+		}
+	})
+
+	t.Run("missing keyId", func(t *testing.T) {
+		req := signedRequest(t, priv, keyID, body)
+		req.Header.Set("Signature", `algorithm="rsa-sha256"`)
+		if _, _, err := s.verifySignature(req, body); err == nil {
+			t.Fatal("verifySignature should reject a Signature with no keyId")
+		}
+	})
+}
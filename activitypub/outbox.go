@@ -0,0 +1,280 @@
+package activitypub
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"html"
+	"net/http"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// ActorHandler serves /actor, the Person object other servers fetch to
+// learn this archive's inbox, outbox and public key.
+func (s *Server) ActorHandler(w http.ResponseWriter, r *http.Request) {
+	pubPEM, err := encodePublicKeyPEM(s.actor.publicKey)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/activity+json")
+	json.NewEncoder(w).Encode(struct {
+		Context           []string `json:"@context"`
+		ID                string   `json:"id"`
+		Type              string   `json:"type"`
+		PreferredUsername string   `json:"preferredUsername"`
+		Inbox             string   `json:"inbox"`
+		Outbox            string   `json:"outbox"`
+		PublicKey         struct {
+			ID           string `json:"id"`
+			Owner        string `json:"owner"`
+			PublicKeyPem string `json:"publicKeyPem"`
+		} `json:"publicKey"`
+	}{
+		Context:           []string{"https://www.w3.org/ns/activitystreams"},
+		ID:                s.actorURL(),
+		Type:              "Person",
+		PreferredUsername: s.username,
+		Inbox:             s.baseURL + "/inbox",
+		Outbox:            s.baseURL + "/outbox",
+		PublicKey: struct {
+			ID           string `json:"id"`
+			Owner        string `json:"owner"`
+			PublicKeyPem string `json:"publicKeyPem"`
+		}{
+			ID:           s.actorURL() + "#main-key",
+			Owner:        s.actorURL(),
+			PublicKeyPem: string(pubPEM),
+		},
+	})
+}
+
+const outboxPageSize = 20
+
+// OutboxHandler serves /outbox, an OrderedCollection of this archive's
+// tweets in descending id order, as Create{Note} activities. That is newest
+// first for Twitter's own ids; the hashed synthetic ids of imported
+// Mastodon and honk posts follow no time order. The first response is
+// just the collection summary; ?page=true walks it a page at a time via
+// max_id, the same cursor style Mastodon's own API uses.
+func (s *Server) OutboxHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/activity+json")
+	if r.FormValue("page") != "true" {
+		var total int
+		if err := s.db.QueryRow(`select count(*) from tweets`).Scan(&total); err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		json.NewEncoder(w).Encode(struct {
+			Context    string `json:"@context"`
+			ID         string `json:"id"`
+			Type       string `json:"type"`
+			TotalItems int    `json:"totalItems"`
+			First      string `json:"first"`
+		}{
+			Context:    "https://www.w3.org/ns/activitystreams",
+			ID:         s.baseURL + "/outbox",
+			Type:       "OrderedCollection",
+			TotalItems: total,
+			First:      s.baseURL + "/outbox?page=true",
+		})
+		return
+	}
+
+	var (
+		rows *sql.Rows
+		err  error
+	)
+	const selectCols = `id::text, text, created_at, array_to_string(hashtags, ','), array_to_string(user_mentions, ',')`
+	if maxID := r.FormValue("max_id"); maxID != "" {
+		rows, err = s.db.Query(
+			`select `+selectCols+` from tweets where id < $1 order by id desc limit $2`,
+			maxID, outboxPageSize)
+	} else {
+		rows, err = s.db.Query(
+			`select `+selectCols+` from tweets order by id desc limit $1`,
+			outboxPageSize)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	defer rows.Close()
+
+	page := struct {
+		Context      string        `json:"@context"`
+		ID           string        `json:"id"`
+		Type         string        `json:"type"`
+		PartOf       string        `json:"partOf"`
+		Next         string        `json:"next,omitempty"`
+		OrderedItems []interface{} `json:"orderedItems"`
+	}{
+		Context: "https://www.w3.org/ns/activitystreams",
+		ID:      s.baseURL + r.URL.RequestURI(),
+		Type:    "OrderedCollectionPage",
+		PartOf:  s.baseURL + "/outbox",
+	}
+	var lastID string
+	for rows.Next() {
+		var id, text, hashtagsCSV, mentionsCSV string
+		var createdAt time.Time
+		if err := rows.Scan(&id, &text, &createdAt, &hashtagsCSV, &mentionsCSV); err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		note := s.renderNote(id, text, createdAt, splitCSV(hashtagsCSV), splitCSV(mentionsCSV))
+		page.OrderedItems = append(page.OrderedItems, s.renderCreate(note))
+		lastID = id
+	}
+	if lastID != "" && len(page.OrderedItems) == outboxPageSize {
+		page.Next = fmt.Sprintf("%s/outbox?page=true&max_id=%s", s.baseURL, lastID)
+	}
+	json.NewEncoder(w).Encode(page)
+}
+
+// TweetHandler serves the canonical permalink for a single tweet,
+// /tweet/{id}, as a Note when ActivityPub clients ask for it and as plain
+// HTML otherwise.
+func (s *Server) TweetHandler(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/tweet/")
+	if id == "" {
+		http.NotFound(w, r)
+		return
+	}
+	var text, hashtagsCSV, mentionsCSV string
+	var createdAt time.Time
+	err := s.db.QueryRow(
+		`select text, created_at, array_to_string(hashtags, ','), array_to_string(user_mentions, ',') from tweets where id = $1`,
+		id,
+	).Scan(&text, &createdAt, &hashtagsCSV, &mentionsCSV)
+	if err == sql.ErrNoRows {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	note := s.renderNote(id, text, createdAt, splitCSV(hashtagsCSV), splitCSV(mentionsCSV))
+	if wantsActivityJSON(r) {
+		w.Header().Set("Content-Type", "application/activity+json")
+		json.NewEncoder(w).Encode(note)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html")
+	fmt.Fprintf(w, "<p>%s</p>", note.Content)
+}
+
+func wantsActivityJSON(r *http.Request) bool {
+	accept := r.Header.Get("Accept")
+	return strings.Contains(accept, "application/activity+json") || strings.Contains(accept, "application/ld+json")
+}
+
+type note struct {
+	ID           string   `json:"id"`
+	Type         string   `json:"type"`
+	AttributedTo string   `json:"attributedTo"`
+	Content      string   `json:"content"`
+	Published    string   `json:"published"`
+	To           []string `json:"to"`
+}
+
+type createActivity struct {
+	Context   string      `json:"@context"`
+	ID        string      `json:"id"`
+	Type      string      `json:"type"`
+	Actor     string      `json:"actor"`
+	Published string      `json:"published"`
+	To        []string    `json:"to"`
+	Object    interface{} `json:"object"`
+}
+
+func (s *Server) renderNote(id, text string, createdAt time.Time, hashtags, mentions []string) note {
+	return note{
+		ID:           s.tweetURL(id),
+		Type:         "Note",
+		AttributedTo: s.actorURL(),
+		Content:      linkify(text, hashtags, mentions),
+		Published:    createdAt.UTC().Format(time.RFC3339),
+		To:           []string{"https://www.w3.org/ns/activitystreams#Public"},
+	}
+}
+
+func (s *Server) renderCreate(n note) createActivity {
+	return createActivity{
+		Context:   "https://www.w3.org/ns/activitystreams",
+		ID:        n.ID + "/activity",
+		Type:      "Create",
+		Actor:     s.actorURL(),
+		Published: n.Published,
+		To:        n.To,
+		Object:    n,
+	}
+}
+
+// linkify turns hashtags and mentions in text into links, the way Mastodon
+// and honk render their own Note content.
+func linkify(text string, hashtags, mentions []string) string {
+	escaped := html.EscapeString(text)
+	for _, tag := range hashtags {
+		if tag == "" {
+			continue
+		}
+		safeTag := html.EscapeString(tag)
+		escaped = replaceToken(escaped, "#"+safeTag,
+			fmt.Sprintf(`<a href="https://twitter.com/hashtag/%s" class="hashtag">#%s</a>`, safeTag, safeTag))
+	}
+	for _, m := range mentions {
+		if m == "" {
+			continue
+		}
+		safeMention := html.EscapeString(m)
+		escaped = replaceToken(escaped, "@"+safeMention,
+			fmt.Sprintf(`<a href="https://twitter.com/%s" class="mention">@%s</a>`, safeMention, safeMention))
+	}
+	return escaped
+}
+
+// replaceToken replaces every whole-word occurrence of token in s with
+// replacement. A bare strings.ReplaceAll would let a hashtag that's a
+// prefix of another, e.g. "love" inside "lovely", corrupt the longer one;
+// requiring that the match isn't followed by a tag-continuation rune keeps
+// "#lovely" intact when only "#love" is being linkified. This is done by
+// hand, rather than with regexp's \b, because \b only recognizes ASCII
+// word characters and would silently fail to match (leaving the tag
+// un-linkified) after a non-ASCII rune such as the "é" in "#café".
+func replaceToken(s, token, replacement string) string {
+	var b strings.Builder
+	rest := s
+	for {
+		i := strings.Index(rest, token)
+		if i < 0 {
+			b.WriteString(rest)
+			return b.String()
+		}
+		b.WriteString(rest[:i])
+		after := rest[i+len(token):]
+		if r, _ := utf8.DecodeRuneInString(after); isTagContinuation(r) {
+			b.WriteString(token)
+		} else {
+			b.WriteString(replacement)
+		}
+		rest = after
+	}
+}
+
+// isTagContinuation reports whether r can continue a hashtag or mention, so
+// replaceToken knows "#love" isn't a whole-word match inside "#lovely".
+func isTagContinuation(r rune) bool {
+	return r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+func splitCSV(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, ",")
+}
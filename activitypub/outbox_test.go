@@ -0,0 +1,55 @@
+package activitypub
+
+import "testing"
+
+func TestLinkify(t *testing.T) {
+	cases := []struct {
+		name     string
+		text     string
+		hashtags []string
+		mentions []string
+		want     string
+	}{
+		{
+			name:     "prefix hashtag doesn't corrupt the longer one",
+			text:     "#love and #lovely",
+			hashtags: []string{"love", "lovely"},
+			want: `<a href="https://twitter.com/hashtag/love" class="hashtag">#love</a> and ` +
+				`<a href="https://twitter.com/hashtag/lovely" class="hashtag">#lovely</a>`,
+		},
+		{
+			name:     "prefix hashtag in the other order",
+			text:     "#love and #lovely",
+			hashtags: []string{"lovely", "love"},
+			want: `<a href="https://twitter.com/hashtag/love" class="hashtag">#love</a> and ` +
+				`<a href="https://twitter.com/hashtag/lovely" class="hashtag">#lovely</a>`,
+		},
+		{
+			name:     "non-ASCII hashtag still linkifies",
+			text:     "I had a #café today",
+			hashtags: []string{"café"},
+			want:     `I had a <a href="https://twitter.com/hashtag/café" class="hashtag">#café</a> today`,
+		},
+		{
+			name:     "mention at end of string",
+			text:     "thanks @friend",
+			mentions: []string{"friend"},
+			want:     `thanks <a href="https://twitter.com/friend" class="mention">@friend</a>`,
+		},
+		{
+			name:     "html in tag is escaped",
+			text:     `foo #"><script> bar`,
+			hashtags: []string{`"><script>`},
+			want: `foo <a href="https://twitter.com/hashtag/&#34;&gt;&lt;script&gt;" class="hashtag">` +
+				`#&#34;&gt;&lt;script&gt;</a> bar`,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := linkify(tc.text, tc.hashtags, tc.mentions); got != tc.want {
+				t.Errorf("linkify(%q, %v, %v) =\n%q\nwant\n%q", tc.text, tc.hashtags, tc.mentions, got, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,43 @@
+package activitypub
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+)
+
+// WebfingerHandler serves /.well-known/webfinger, the discovery step
+// Fediverse software uses to turn "user@host" into this actor's URL.
+func (s *Server) WebfingerHandler(w http.ResponseWriter, r *http.Request) {
+	resource := r.FormValue("resource")
+	if resource != "acct:"+s.username+"@"+hostOf(s.baseURL) {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "application/jrd+json")
+	json.NewEncoder(w).Encode(struct {
+		Subject string `json:"subject"`
+		Links   []struct {
+			Rel  string `json:"rel"`
+			Type string `json:"type"`
+			Href string `json:"href"`
+		} `json:"links"`
+	}{
+		Subject: resource,
+		Links: []struct {
+			Rel  string `json:"rel"`
+			Type string `json:"type"`
+			Href string `json:"href"`
+		}{
+			{Rel: "self", Type: "application/activity+json", Href: s.actorURL()},
+		},
+	})
+}
+
+func hostOf(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return rawURL
+	}
+	return u.Host
+}
@@ -0,0 +1,552 @@
+package main
+
+import (
+	"archive/zip"
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"html"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Importer knows how to recognize and ingest one flavor of export archive
+// (Twitter's legacy/GDPR formats, Mastodon's outbox, honk's export, ...)
+// into the tweets table.
+type Importer interface {
+	// Detect reports whether r looks like an archive this importer
+	// understands.
+	Detect(r io.ReaderAt, size int64) bool
+	// Import reads the archive this importer was constructed with and
+	// inserts its contents into db.
+	Import(ctx context.Context, db *DB) error
+}
+
+// importerFactories lists every known Importer, in the order UploadHandler
+// should probe them. The Twitter GDPR/Mastodon/honk checks each look for
+// one specific named file; the legacy Twitter layout, which needs several
+// data/js files plus at least one file matching tweetJsonGlob, is tried
+// last.
+var importerFactories = []func(io.ReaderAt, int64) Importer{
+	newModernTwitterImporter,
+	newMastodonImporter,
+	newHonkImporter,
+	newLegacyTwitterImporter,
+}
+
+// DetectImporter returns the first Importer willing to claim the archive in
+// r, or nil if none recognize it.
+func DetectImporter(r io.ReaderAt, size int64) Importer {
+	for _, factory := range importerFactories {
+		imp := factory(r, size)
+		if imp.Detect(r, size) {
+			return imp
+		}
+	}
+	return nil
+}
+
+func zipPaths(zr *zip.Reader) map[string]*zip.File {
+	paths := make(map[string]*zip.File, len(zr.File))
+	for _, f := range zr.File {
+		paths[f.Name] = f
+	}
+	return paths
+}
+
+func readZipFile(f *zip.File) ([]byte, error) {
+	rc, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return ioutil.ReadAll(rc)
+}
+
+// stripJSPrefix consumes everything up to the first '[' or '{' from r
+// without buffering it, leaving a reader positioned at the start of the
+// JSON value. Twitter's export files are a JavaScript assignment
+// (`window.foo = ` or `window.YTD.tweet.part0 = `) followed by the JSON
+// array proper; this lets callers decode straight from the zip entry
+// instead of reading the whole file into memory first.
+func stripJSPrefix(r io.Reader) (io.Reader, error) {
+	br := bufio.NewReader(r)
+	for {
+		c, err := br.Peek(1)
+		if err != nil {
+			return nil, err
+		}
+		if c[0] == '[' || c[0] == '{' {
+			return br, nil
+		}
+		if _, err := br.ReadByte(); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// ProgressTracker receives progress updates from an Importer as it works
+// through an archive. Used by the ImportJob subsystem to drive /jobs
+// status and events. When an Importer runs with no tracker in its context,
+// progressFromContext supplies a no-op one.
+type ProgressTracker interface {
+	// SetTotalFiles records how many files this archive's Import will
+	// process, once known.
+	SetTotalFiles(n int)
+	// FileDone is called once a file has been fully processed.
+	FileDone()
+	// AddTweets records progress through an individual file: how many
+	// tweets it held, and how many of those were newly inserted.
+	AddTweets(attempted, inserted int)
+}
+
+type contextKey int
+
+const progressContextKey contextKey = 0
+
+// WithProgress returns a copy of ctx carrying t, so Importer.Import can
+// report progress through it.
+func WithProgress(ctx context.Context, t ProgressTracker) context.Context {
+	return context.WithValue(ctx, progressContextKey, t)
+}
+
+func progressFromContext(ctx context.Context) ProgressTracker {
+	if t, ok := ctx.Value(progressContextKey).(ProgressTracker); ok {
+		return t
+	}
+	return noopProgressTracker{}
+}
+
+type noopProgressTracker struct{}
+
+func (noopProgressTracker) SetTotalFiles(int)  {}
+func (noopProgressTracker) FileDone()          {}
+func (noopProgressTracker) AddTweets(int, int) {}
+
+// syntheticID derives a stable bigint-range id for sources, like Mastodon
+// and honk, that don't hand out Twitter-style numeric ids, so their posts
+// can still live in the tweets table's bigint primary key.
+func syntheticID(uri string) string {
+	h := fnv.New64a()
+	io.WriteString(h, uri)
+	return strconv.FormatUint(h.Sum64()&0x7fffffffffffffff, 10)
+}
+
+var htmlTag = regexp.MustCompile(`<[^>]*>`)
+
+// stripHTML turns a fragment of ActivityStreams/honk HTML content into the
+// plaintext we store in the tweets table's text column.
+func stripHTML(s string) string {
+	s = strings.NewReplacer(
+		"<br>", "\n",
+		"<br/>", "\n",
+		"<br />", "\n",
+		"</p>", "\n\n",
+	).Replace(s)
+	s = htmlTag.ReplaceAllString(s, "")
+	return strings.TrimSpace(html.UnescapeString(s))
+}
+
+// ---- legacy Twitter archive: data/js/tweets/YYYY_MM.js ----
+
+const tweetJsonGlob = `data/js/tweets/????_??.js`
+
+type legacyTwitterImporter struct {
+	r    io.ReaderAt
+	size int64
+}
+
+func newLegacyTwitterImporter(r io.ReaderAt, size int64) Importer {
+	return &legacyTwitterImporter{r, size}
+}
+
+func (imp *legacyTwitterImporter) Detect(r io.ReaderAt, size int64) bool {
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return false
+	}
+	paths := zipPaths(zr)
+	expected := []string{
+		"data/js/tweet_index.js",
+		"data/js/user_details.js",
+		"data/js/payload_details.js",
+	}
+	for _, path := range expected {
+		if paths[path] == nil {
+			return false
+		}
+	}
+	for path := range paths {
+		if matched, _ := filepath.Match(tweetJsonGlob, path); matched {
+			return true
+		}
+	}
+	return false
+}
+
+func (imp *legacyTwitterImporter) Import(ctx context.Context, db *DB) error {
+	zr, err := zip.NewReader(imp.r, imp.size)
+	if err != nil {
+		return err
+	}
+	var files []*zip.File
+	for _, f := range zr.File {
+		if matched, _ := filepath.Match(tweetJsonGlob, f.Name); matched {
+			files = append(files, f)
+		}
+	}
+	bundledMedia := bundledMediaByTweet(zr)
+	progress := progressFromContext(ctx)
+	progress.SetTotalFiles(len(files))
+	for _, f := range files {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := importTweetFile(db, f, progress, bundledMedia); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// importTweetFile decodes a single YYYY_MM.js/tweet.js-style file straight
+// from the zip entry, inserts its tweets, and archives whatever media goes
+// with each one, as found in bundledMedia.
+func importTweetFile(db *DB, f *zip.File, progress ProgressTracker, bundledMedia map[int64][]*zip.File) error {
+	rc, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	jr, err := stripJSPrefix(rc)
+	if err != nil {
+		return err
+	}
+	var tweets []interface{}
+	if err := json.NewDecoder(jr).Decode(&tweets); err != nil {
+		return err
+	}
+	inserted, err := db.insertTweets(tweets)
+	if err != nil {
+		return err
+	}
+	for _, it := range tweets {
+		t, ok := it.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		idStr, ok := t["id_str"].(string)
+		if !ok {
+			continue
+		}
+		id, err := strconv.ParseInt(idStr, 10, 64)
+		if err != nil {
+			continue
+		}
+		archiveTweetMedia(db, id, t, bundledMedia[id])
+	}
+	progress.AddTweets(len(tweets), inserted)
+	progress.FileDone()
+	return nil
+}
+
+// ---- modern Twitter GDPR export: tweet.js / tweets.js (+ tweet-headers.js) ----
+
+type modernTwitterImporter struct {
+	r    io.ReaderAt
+	size int64
+}
+
+func newModernTwitterImporter(r io.ReaderAt, size int64) Importer {
+	return &modernTwitterImporter{r, size}
+}
+
+func (imp *modernTwitterImporter) tweetFiles(zr *zip.Reader) []*zip.File {
+	var files []*zip.File
+	for _, f := range zr.File {
+		switch filepath.Base(f.Name) {
+		case "tweet.js", "tweets.js":
+			files = append(files, f)
+		}
+	}
+	return files
+}
+
+func (imp *modernTwitterImporter) Detect(r io.ReaderAt, size int64) bool {
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return false
+	}
+	return len(imp.tweetFiles(zr)) > 0
+}
+
+func (imp *modernTwitterImporter) Import(ctx context.Context, db *DB) error {
+	zr, err := zip.NewReader(imp.r, imp.size)
+	if err != nil {
+		return err
+	}
+	headers, err := imp.readHeaders(zr)
+	if err != nil {
+		return err
+	}
+	files := imp.tweetFiles(zr)
+	progress := progressFromContext(ctx)
+	progress.SetTotalFiles(len(files))
+	for _, f := range files {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return err
+		}
+		jr, err := stripJSPrefix(rc)
+		if err != nil {
+			rc.Close()
+			return err
+		}
+		var wrapped []map[string]interface{}
+		err = json.NewDecoder(jr).Decode(&wrapped)
+		rc.Close()
+		if err != nil {
+			return err
+		}
+		tweets := make([]interface{}, 0, len(wrapped))
+		for _, entry := range wrapped {
+			t, ok := entry["tweet"].(map[string]interface{})
+			if !ok {
+				t = entry
+			}
+			if id, _ := t["id_str"].(string); id != "" {
+				if h, ok := headers[id]; ok {
+					t["headers"] = h
+				}
+			}
+			tweets = append(tweets, t)
+		}
+		inserted, err := db.insertTweets(tweets)
+		if err != nil {
+			return err
+		}
+		for _, it := range tweets {
+			t, ok := it.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			idStr, ok := t["id_str"].(string)
+			if !ok {
+				continue
+			}
+			id, err := strconv.ParseInt(idStr, 10, 64)
+			if err != nil {
+				continue
+			}
+			archiveTweetMedia(db, id, t, nil)
+		}
+		progress.AddTweets(len(tweets), inserted)
+		progress.FileDone()
+	}
+	return nil
+}
+
+// readHeaders parses tweet-headers.js, if present, into a map keyed by
+// id_str so its metadata can be merged onto the matching tweet.
+func (imp *modernTwitterImporter) readHeaders(zr *zip.Reader) (map[string]interface{}, error) {
+	headers := make(map[string]interface{})
+	for _, f := range zr.File {
+		if filepath.Base(f.Name) != "tweet-headers.js" {
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return nil, err
+		}
+		jr, err := stripJSPrefix(rc)
+		if err != nil {
+			rc.Close()
+			return nil, err
+		}
+		var entries []map[string]interface{}
+		err = json.NewDecoder(jr).Decode(&entries)
+		rc.Close()
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range entries {
+			h, ok := e["tweetHeader"].(map[string]interface{})
+			if !ok {
+				h = e
+			}
+			if id, _ := h["id_str"].(string); id != "" {
+				headers[id] = h
+			}
+		}
+	}
+	return headers, nil
+}
+
+// ---- Mastodon ActivityStreams outbox.json export ----
+
+type mastodonImporter struct {
+	r    io.ReaderAt
+	size int64
+}
+
+func newMastodonImporter(r io.ReaderAt, size int64) Importer {
+	return &mastodonImporter{r, size}
+}
+
+func (imp *mastodonImporter) outboxFile(zr *zip.Reader) *zip.File {
+	for _, f := range zr.File {
+		if filepath.Base(f.Name) == "outbox.json" {
+			return f
+		}
+	}
+	return nil
+}
+
+func (imp *mastodonImporter) Detect(r io.ReaderAt, size int64) bool {
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return false
+	}
+	return imp.outboxFile(zr) != nil
+}
+
+type asOutbox struct {
+	OrderedItems []asActivity `json:"orderedItems"`
+}
+
+type asActivity struct {
+	Type   string `json:"type"`
+	Object struct {
+		ID        string `json:"id"`
+		Content   string `json:"content"`
+		Published string `json:"published"`
+	} `json:"object"`
+}
+
+func (imp *mastodonImporter) Import(ctx context.Context, db *DB) error {
+	zr, err := zip.NewReader(imp.r, imp.size)
+	if err != nil {
+		return err
+	}
+	f := imp.outboxFile(zr)
+	if f == nil {
+		return fmt.Errorf("tweetarchive: outbox.json disappeared from archive")
+	}
+	b, err := readZipFile(f)
+	if err != nil {
+		return err
+	}
+	var outbox asOutbox
+	if err := json.Unmarshal(b, &outbox); err != nil {
+		return err
+	}
+	tweets := make([]interface{}, 0, len(outbox.OrderedItems))
+	for _, item := range outbox.OrderedItems {
+		if item.Type != "Create" || item.Object.ID == "" {
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		tweets = append(tweets, map[string]interface{}{
+			"id_str":     syntheticID(item.Object.ID),
+			"created_at": item.Object.Published,
+			"text":       stripHTML(item.Object.Content),
+		})
+	}
+	progress := progressFromContext(ctx)
+	progress.SetTotalFiles(1)
+	inserted, err := db.insertTweets(tweets)
+	if err != nil {
+		return err
+	}
+	progress.AddTweets(len(tweets), inserted)
+	progress.FileDone()
+	return nil
+}
+
+// ---- honk export: honks.json ----
+
+type honkEntry struct {
+	XID    string `json:"xid"`
+	Date   string `json:"date"`
+	Noise  string `json:"noise"`
+	Honker string `json:"honker"`
+}
+
+type honkImporter struct {
+	r    io.ReaderAt
+	size int64
+}
+
+func newHonkImporter(r io.ReaderAt, size int64) Importer {
+	return &honkImporter{r, size}
+}
+
+func (imp *honkImporter) honksFile(zr *zip.Reader) *zip.File {
+	for _, f := range zr.File {
+		if filepath.Base(f.Name) == "honks.json" {
+			return f
+		}
+	}
+	return nil
+}
+
+func (imp *honkImporter) Detect(r io.ReaderAt, size int64) bool {
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return false
+	}
+	return imp.honksFile(zr) != nil
+}
+
+func (imp *honkImporter) Import(ctx context.Context, db *DB) error {
+	zr, err := zip.NewReader(imp.r, imp.size)
+	if err != nil {
+		return err
+	}
+	f := imp.honksFile(zr)
+	if f == nil {
+		return fmt.Errorf("tweetarchive: honks.json disappeared from archive")
+	}
+	b, err := readZipFile(f)
+	if err != nil {
+		return err
+	}
+	var honks []honkEntry
+	if err := json.Unmarshal(b, &honks); err != nil {
+		return err
+	}
+	tweets := make([]interface{}, 0, len(honks))
+	for _, h := range honks {
+		if h.XID == "" {
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		tweets = append(tweets, map[string]interface{}{
+			"id_str":     syntheticID(h.XID),
+			"created_at": h.Date,
+			"text":       stripHTML(h.Noise),
+		})
+	}
+	progress := progressFromContext(ctx)
+	progress.SetTotalFiles(1)
+	inserted, err := db.insertTweets(tweets)
+	if err != nil {
+		return err
+	}
+	progress.AddTweets(len(tweets), inserted)
+	progress.FileDone()
+	return nil
+}
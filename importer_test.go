@@ -0,0 +1,169 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// buildZip assembles an in-memory zip archive from path->contents, for
+// feeding to Importer.Detect without touching disk.
+func buildZip(t *testing.T, files map[string]string) *bytes.Reader {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for name, contents := range files {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatalf("zw.Create(%q): %v", name, err)
+		}
+		if _, err := w.Write([]byte(contents)); err != nil {
+			t.Fatalf("writing %q: %v", name, err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatalf("zw.Close: %v", err)
+	}
+	return bytes.NewReader(buf.Bytes())
+}
+
+func TestDetectImporter(t *testing.T) {
+	cases := []struct {
+		name  string
+		files map[string]string
+		want  string
+	}{
+		{
+			name: "legacy twitter",
+			files: map[string]string{
+				"data/js/tweet_index.js":    `window.YTD.tweet_index.part0 = []`,
+				"data/js/user_details.js":   `window.YTD.user_details.part0 = {}`,
+				"data/js/payload_details.js": `window.YTD.payload_details.part0 = {}`,
+				"data/js/tweets/2020_01.js": `window.YTD.tweets.part0 = []`,
+			},
+			want: "*main.legacyTwitterImporter",
+		},
+		{
+			name: "modern twitter GDPR",
+			files: map[string]string{
+				"data/tweets.js": `window.YTD.tweets.part0 = []`,
+			},
+			want: "*main.modernTwitterImporter",
+		},
+		{
+			name: "mastodon outbox",
+			files: map[string]string{
+				"outbox.json": `{"orderedItems":[]}`,
+			},
+			want: "*main.mastodonImporter",
+		},
+		{
+			name: "honk",
+			files: map[string]string{
+				"honks.json": `[]`,
+			},
+			want: "*main.honkImporter",
+		},
+		{
+			name: "unrecognized",
+			files: map[string]string{
+				"readme.txt": "hello",
+			},
+			want: "",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			r := buildZip(t, tc.files)
+			imp := DetectImporter(r, r.Size())
+			if tc.want == "" {
+				if imp != nil {
+					t.Fatalf("DetectImporter = %T, want nil", imp)
+				}
+				return
+			}
+			got := typeName(imp)
+			if got != tc.want {
+				t.Fatalf("DetectImporter = %s, want %s", got, tc.want)
+			}
+		})
+	}
+}
+
+func typeName(imp Importer) string {
+	switch imp.(type) {
+	case *legacyTwitterImporter:
+		return "*main.legacyTwitterImporter"
+	case *modernTwitterImporter:
+		return "*main.modernTwitterImporter"
+	case *mastodonImporter:
+		return "*main.mastodonImporter"
+	case *honkImporter:
+		return "*main.honkImporter"
+	default:
+		return "unknown"
+	}
+}
+
+func TestStripJSPrefix(t *testing.T) {
+	cases := []struct {
+		in   string
+		want string
+	}{
+		{`window.YTD.tweets.part0 = [{"id_str":"1"}]`, `[{"id_str":"1"}]`},
+		{`window.YTD.tweet_index.part0 = {}`, `{}`},
+		{`[{"id_str":"1"}]`, `[{"id_str":"1"}]`},
+	}
+	for _, tc := range cases {
+		r, err := stripJSPrefix(strings.NewReader(tc.in))
+		if err != nil {
+			t.Fatalf("stripJSPrefix(%q): %v", tc.in, err)
+		}
+		buf := new(bytes.Buffer)
+		buf.ReadFrom(r)
+		if got := buf.String(); got != tc.want {
+			t.Errorf("stripJSPrefix(%q) = %q, want %q", tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestStripJSPrefixNoJSON(t *testing.T) {
+	if _, err := stripJSPrefix(strings.NewReader("window.YTD = ")); err == nil {
+		t.Fatal("stripJSPrefix on input with no JSON value should error")
+	}
+}
+
+func TestStripHTML(t *testing.T) {
+	cases := []struct {
+		in   string
+		want string
+	}{
+		{"<p>hello <b>world</b></p>", "hello world"},
+		{"line one<br>line two", "line one\nline two"},
+		{"a &amp; b", "a & b"},
+		{"<p>one</p><p>two</p>", "one\n\ntwo"},
+	}
+	for _, tc := range cases {
+		if got := stripHTML(tc.in); got != tc.want {
+			t.Errorf("stripHTML(%q) = %q, want %q", tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestSyntheticID(t *testing.T) {
+	a := syntheticID("https://example.social/users/alice/statuses/1")
+	b := syntheticID("https://example.social/users/alice/statuses/2")
+	if a == b {
+		t.Fatal("syntheticID should differ for different URIs")
+	}
+	if a != syntheticID("https://example.social/users/alice/statuses/1") {
+		t.Fatal("syntheticID should be stable for the same URI")
+	}
+	n, err := strconv.ParseInt(a, 10, 64)
+	if err != nil || n < 0 {
+		t.Fatalf("syntheticID returned %q, not a valid non-negative bigint", a)
+	}
+}
@@ -0,0 +1,476 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ImportJob tracks the progress of one archive import, so UploadHandler can
+// hand the work off to a worker goroutine instead of blocking the request
+// until a multi-year archive finishes inserting.
+type ImportJob struct {
+	ID             int64      `json:"id"`
+	Filename       string     `json:"filename"`
+	State          string     `json:"state"`
+	TotalFiles     int        `json:"total_files"`
+	ProcessedFiles int        `json:"processed_files"`
+	TotalTweets    int        `json:"total_tweets"`
+	InsertedTweets int        `json:"inserted_tweets"`
+	Error          string     `json:"error,omitempty"`
+	StartedAt      *time.Time `json:"started_at,omitempty"`
+	FinishedAt     *time.Time `json:"finished_at,omitempty"`
+}
+
+const (
+	jobStateQueued  = "queued"
+	jobStateRunning = "running"
+	jobStateDone    = "done"
+	jobStateFailed  = "failed"
+)
+
+const importJobsSql = `
+create table import_jobs (
+	id serial primary key,
+	filename text not null,
+	state text not null default 'queued',
+	total_files integer not null default 0,
+	processed_files integer not null default 0,
+	total_tweets integer not null default 0,
+	inserted_tweets integer not null default 0,
+	error text,
+	started_at timestamp,
+	finished_at timestamp,
+	created_at timestamp not null default now()
+);
+`
+
+func (d *DB) createImportJobsTable() error {
+	tx, err := d.conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Commit()
+	_, err = tx.Exec(importJobsSql)
+	return err
+}
+
+// uploadsDir is where UploadHandler persists uploaded archives, so a worker
+// can read them back, and so a job interrupted by a crash still has its
+// upload on disk to resume from.
+var uploadsDir = "."
+
+// createImportJob persists a new job row in the queued state and returns
+// its id.
+func (d *DB) createImportJob(filename string) (int64, error) {
+	var id int64
+	err := d.conn.QueryRow(
+		`insert into import_jobs (filename, state) values ($1, $2) returning id`,
+		filename, jobStateQueued,
+	).Scan(&id)
+	return id, err
+}
+
+func (d *DB) getImportJob(id int64) (*ImportJob, error) {
+	row := d.conn.QueryRow(
+		`select id, filename, state, total_files, processed_files, total_tweets, inserted_tweets,
+		        coalesce(error, ''), started_at, finished_at
+		 from import_jobs where id = $1`, id)
+	j := &ImportJob{}
+	if err := row.Scan(&j.ID, &j.Filename, &j.State, &j.TotalFiles, &j.ProcessedFiles,
+		&j.TotalTweets, &j.InsertedTweets, &j.Error, &j.StartedAt, &j.FinishedAt); err != nil {
+		return nil, err
+	}
+	return j, nil
+}
+
+func (d *DB) listImportJobs() ([]*ImportJob, error) {
+	rows, err := d.conn.Query(
+		`select id, filename, state, total_files, processed_files, total_tweets, inserted_tweets,
+		        coalesce(error, ''), started_at, finished_at
+		 from import_jobs order by id desc`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var jobs []*ImportJob
+	for rows.Next() {
+		j := &ImportJob{}
+		if err := rows.Scan(&j.ID, &j.Filename, &j.State, &j.TotalFiles, &j.ProcessedFiles,
+			&j.TotalTweets, &j.InsertedTweets, &j.Error, &j.StartedAt, &j.FinishedAt); err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, j)
+	}
+	return jobs, rows.Err()
+}
+
+// resumableImportJobs returns jobs left in the running state by a process
+// that crashed mid-import, so they can be re-run. Re-running is safe
+// because insertTweets is idempotent on tweet id.
+func (d *DB) resumableImportJobs() ([]*ImportJob, error) {
+	rows, err := d.conn.Query(
+		`select id, filename, state, total_files, processed_files, total_tweets, inserted_tweets,
+		        coalesce(error, ''), started_at, finished_at
+		 from import_jobs where state = $1 order by id`, jobStateRunning)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var jobs []*ImportJob
+	for rows.Next() {
+		j := &ImportJob{}
+		if err := rows.Scan(&j.ID, &j.Filename, &j.State, &j.TotalFiles, &j.ProcessedFiles,
+			&j.TotalTweets, &j.InsertedTweets, &j.Error, &j.StartedAt, &j.FinishedAt); err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, j)
+	}
+	return jobs, rows.Err()
+}
+
+func (d *DB) markJobRunning(id int64) error {
+	_, err := d.conn.Exec(
+		`update import_jobs set state = $1, started_at = now() where id = $2`, jobStateRunning, id)
+	return err
+}
+
+func (d *DB) markJobDone(id int64) error {
+	_, err := d.conn.Exec(
+		`update import_jobs set state = $1, finished_at = now() where id = $2`, jobStateDone, id)
+	return err
+}
+
+func (d *DB) markJobFailed(id int64, jobErr error) error {
+	_, err := d.conn.Exec(
+		`update import_jobs set state = $1, error = $2, finished_at = now() where id = $3`,
+		jobStateFailed, jobErr.Error(), id)
+	return err
+}
+
+// importJobQueue is the channel of job ids waiting for a worker. It's
+// buffered generously since enqueueing only happens from UploadHandler and
+// job resumption at startup.
+var importJobQueue = make(chan int64, 1000)
+
+// startImportWorkers launches n goroutines that pull job ids off
+// importJobQueue and run them one at a time, bounding how many imports run
+// concurrently against the database.
+func startImportWorkers(n int) {
+	for i := 0; i < n; i++ {
+		go func() {
+			for jobID := range importJobQueue {
+				runImportJob(jobID)
+			}
+		}()
+	}
+}
+
+// resumeCrashedJobs re-enqueues any job left running from a previous,
+// presumably crashed, process.
+func resumeCrashedJobs() {
+	jobs, err := db.resumableImportJobs()
+	if err != nil {
+		log.Println("jobs: couldn't list resumable jobs:", err)
+		return
+	}
+	for _, j := range jobs {
+		log.Printf("jobs: resuming job %d (%s)", j.ID, j.Filename)
+		importJobQueue <- j.ID
+	}
+}
+
+// runImportJob loads the job's uploaded archive back off disk, detects its
+// format, and imports it, reporting progress into the import_jobs row and
+// over jobEvents as it goes.
+//
+// It recovers from panics in imp.Import: an importer panicking on a
+// malformed archive must fail that one job, not take down the process (and
+// resumeCrashedJobs would otherwise re-enqueue the same archive forever).
+func runImportJob(jobID int64) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Println("jobs: recovered panic in job", jobID, ":", r)
+			db.markJobFailed(jobID, fmt.Errorf("import panicked: %v", r))
+			jobEvents.publish(jobID)
+		}
+	}()
+
+	job, err := db.getImportJob(jobID)
+	if err != nil {
+		log.Println("jobs: couldn't load job", jobID, err)
+		return
+	}
+	if err := db.markJobRunning(jobID); err != nil {
+		log.Println("jobs: couldn't mark job running:", err)
+	}
+	jobEvents.publish(jobID)
+
+	path := filepath.Join(uploadsDir, jobFilename(jobID, job.Filename))
+	f, err := os.Open(path)
+	if err != nil {
+		db.markJobFailed(jobID, err)
+		jobEvents.publish(jobID)
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		db.markJobFailed(jobID, err)
+		jobEvents.publish(jobID)
+		return
+	}
+
+	imp := DetectImporter(f, info.Size())
+	if imp == nil {
+		db.markJobFailed(jobID, fmt.Errorf("unrecognized archive format"))
+		jobEvents.publish(jobID)
+		return
+	}
+
+	progress := &dbProgressTracker{jobID: jobID}
+	ctx := WithProgress(context.Background(), progress)
+	if err := imp.Import(ctx, db); err != nil {
+		db.markJobFailed(jobID, err)
+		jobEvents.publish(jobID)
+		return
+	}
+	if err := db.markJobDone(jobID); err != nil {
+		log.Println("jobs: couldn't mark job done:", err)
+	}
+	jobEvents.publish(jobID)
+
+	if ap != nil {
+		if n, err := ap.FanOutNew(context.Background()); err != nil {
+			log.Println("activitypub: fanning out new tweets:", err)
+		} else {
+			log.Printf("activitypub: announced %d new tweets to followers", n)
+		}
+	}
+}
+
+// jobFilename is the name an uploaded archive is stored under in
+// uploadsDir: the job id keeps concurrent uploads of same-named files from
+// colliding, and survives a rename of the database.
+func jobFilename(jobID int64, original string) string {
+	return strconv.FormatInt(jobID, 10) + "-" + filepath.Base(original)
+}
+
+// dbProgressTracker implements ProgressTracker by writing each update
+// straight into the job's import_jobs row, then publishing to jobEvents so
+// any open /jobs/{id}/events stream picks it up.
+type dbProgressTracker struct {
+	jobID int64
+}
+
+func (t *dbProgressTracker) SetTotalFiles(n int) {
+	db.conn.Exec(`update import_jobs set total_files = $1 where id = $2`, n, t.jobID)
+	jobEvents.publish(t.jobID)
+}
+
+func (t *dbProgressTracker) FileDone() {
+	db.conn.Exec(`update import_jobs set processed_files = processed_files + 1 where id = $1`, t.jobID)
+	jobEvents.publish(t.jobID)
+}
+
+func (t *dbProgressTracker) AddTweets(attempted, inserted int) {
+	db.conn.Exec(
+		`update import_jobs set total_tweets = total_tweets + $1, inserted_tweets = inserted_tweets + $2 where id = $3`,
+		attempted, inserted, t.jobID)
+	jobEvents.publish(t.jobID)
+}
+
+// jobEventBroadcaster lets /jobs/{id}/events subscribers wake up whenever a
+// job's row changes, without polling the database themselves.
+type jobEventBroadcaster struct {
+	mu   sync.Mutex
+	subs map[int64][]chan struct{}
+}
+
+var jobEvents = &jobEventBroadcaster{subs: make(map[int64][]chan struct{})}
+
+func (b *jobEventBroadcaster) subscribe(jobID int64) chan struct{} {
+	ch := make(chan struct{}, 1)
+	b.mu.Lock()
+	b.subs[jobID] = append(b.subs[jobID], ch)
+	b.mu.Unlock()
+	return ch
+}
+
+func (b *jobEventBroadcaster) unsubscribe(jobID int64, ch chan struct{}) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	subs := b.subs[jobID]
+	for i, c := range subs {
+		if c == ch {
+			b.subs[jobID] = append(subs[:i], subs[i+1:]...)
+			break
+		}
+	}
+}
+
+func (b *jobEventBroadcaster) publish(jobID int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, ch := range b.subs[jobID] {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// UploadHandler accepts an uploaded archive, persists it to uploadsDir, and
+// enqueues an ImportJob to ingest it in the background, returning the job
+// id so the client can poll or subscribe to its progress instead of
+// blocking the request until the import finishes.
+func UploadHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Write(uploadHtml)
+		return
+	}
+	f, header, err := r.FormFile("zipfile")
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	defer f.Close()
+
+	jobID, err := db.createImportJob(header.Filename)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	// From here on, any failure to get the upload onto disk must mark the
+	// job failed rather than just returning an error: the row already
+	// exists in the queued state, and resumeCrashedJobs only re-queues
+	// jobs left running, so an abandoned queued row would otherwise sit
+	// in /jobs forever with no file behind it.
+	out, err := os.Create(filepath.Join(uploadsDir, jobFilename(jobID, header.Filename)))
+	if err != nil {
+		db.markJobFailed(jobID, err)
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	defer out.Close()
+	if _, err := io.Copy(out, f); err != nil {
+		db.markJobFailed(jobID, err)
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	importJobQueue <- jobID
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]interface{}{"id": jobID})
+}
+
+// JobHandler serves GET /jobs/{id}, a JSON snapshot of one import job's
+// progress, and GET /jobs/{id}/events, a server-sent events stream of the
+// same so the upload page can show a live progress bar.
+func JobHandler(w http.ResponseWriter, r *http.Request) {
+	rest := strings.TrimPrefix(r.URL.Path, "/jobs/")
+	parts := strings.SplitN(rest, "/", 2)
+	id, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	if len(parts) == 2 && parts[1] == "events" {
+		jobEventsHandler(w, r, id)
+		return
+	}
+	job, err := db.getImportJob(id)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(job)
+}
+
+func jobEventsHandler(w http.ResponseWriter, r *http.Request, id int64) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", 500)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+
+	ch := jobEvents.subscribe(id)
+	defer jobEvents.unsubscribe(id, ch)
+
+	writeJobEvent := func() bool {
+		job, err := db.getImportJob(id)
+		if err != nil {
+			return false
+		}
+		b, err := json.Marshal(job)
+		if err != nil {
+			return false
+		}
+		fmt.Fprintf(w, "data: %s\n\n", b)
+		flusher.Flush()
+		return job.State == jobStateDone || job.State == jobStateFailed
+	}
+	if writeJobEvent() {
+		return
+	}
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-ch:
+			if writeJobEvent() {
+				return
+			}
+		}
+	}
+}
+
+var jobsListTemplate = template.Must(template.New("jobs").Parse(`<!DOCTYPE html>
+<html>
+<head><title>import jobs</title></head>
+<body>
+<h1>import jobs</h1>
+<table border="1" cellpadding="4">
+<tr><th>id</th><th>filename</th><th>state</th><th>files</th><th>tweets</th><th>error</th></tr>
+{{range .}}
+<tr>
+<td><a href="/jobs/{{.ID}}">{{.ID}}</a></td>
+<td>{{.Filename}}</td>
+<td>{{.State}}</td>
+<td>{{.ProcessedFiles}}/{{.TotalFiles}}</td>
+<td>{{.InsertedTweets}}/{{.TotalTweets}}</td>
+<td>{{.Error}}</td>
+</tr>
+{{end}}
+</table>
+</body>
+</html>
+`))
+
+// JobsListHandler serves GET /jobs, an HTML table of every import job,
+// newest first.
+func JobsListHandler(w http.ResponseWriter, r *http.Request) {
+	jobs, err := db.listImportJobs()
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html")
+	jobsListTemplate.Execute(w, jobs)
+}
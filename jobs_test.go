@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"testing"
+	"time"
+)
+
+// fakeJobsConn is a minimal database/sql/driver.Conn that answers
+// ExecContext/QueryContext straight out of per-test handler funcs, so
+// markJobRunning/markJobFailed/resumableImportJobs can be exercised without
+// a real Postgres connection.
+type fakeJobsConn struct {
+	execFn  func(query string, args []driver.NamedValue) (driver.Result, error)
+	queryFn func(query string, args []driver.NamedValue) (driver.Rows, error)
+}
+
+func (c *fakeJobsConn) Prepare(query string) (driver.Stmt, error) { return nil, errors.New("unused") }
+func (c *fakeJobsConn) Close() error                              { return nil }
+func (c *fakeJobsConn) Begin() (driver.Tx, error)                 { return fakeJobsTx{}, nil }
+
+func (c *fakeJobsConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	return c.execFn(query, args)
+}
+
+func (c *fakeJobsConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	return c.queryFn(query, args)
+}
+
+type fakeJobsTx struct{}
+
+func (fakeJobsTx) Commit() error   { return nil }
+func (fakeJobsTx) Rollback() error { return nil }
+
+type fakeJobsResult struct{ affected int64 }
+
+func (r fakeJobsResult) LastInsertId() (int64, error) { return 0, nil }
+func (r fakeJobsResult) RowsAffected() (int64, error) { return r.affected, nil }
+
+// fakeJobRows feeds back a fixed set of import_jobs rows in the column
+// order resumableImportJobs/getImportJob/listImportJobs all select in.
+type fakeJobRows struct {
+	rows [][]driver.Value
+	pos  int
+}
+
+func (r *fakeJobRows) Columns() []string {
+	return []string{"id", "filename", "state", "total_files", "processed_files",
+		"total_tweets", "inserted_tweets", "error", "started_at", "finished_at"}
+}
+func (r *fakeJobRows) Close() error { return nil }
+func (r *fakeJobRows) Next(dest []driver.Value) error {
+	if r.pos >= len(r.rows) {
+		return io.EOF
+	}
+	copy(dest, r.rows[r.pos])
+	r.pos++
+	return nil
+}
+
+type fakeJobsDriver struct{ conn *fakeJobsConn }
+
+func (d fakeJobsDriver) Open(name string) (driver.Conn, error) { return d.conn, nil }
+
+// newFakeJobsDB registers a one-off driver wired to conn and returns a *DB
+// backed by it. Each test gets its own driver name so they don't collide.
+func newFakeJobsDB(t *testing.T, conn *fakeJobsConn) *DB {
+	t.Helper()
+	name := "fakejobsdriver-" + t.Name()
+	sql.Register(name, fakeJobsDriver{conn: conn})
+	db, err := sql.Open(name, "")
+	if err != nil {
+		t.Fatalf("sql.Open: %v", err)
+	}
+	return &DB{conn: db}
+}
+
+func TestMarkJobRunning(t *testing.T) {
+	var gotQuery string
+	var gotArgs []driver.NamedValue
+	conn := &fakeJobsConn{
+		execFn: func(query string, args []driver.NamedValue) (driver.Result, error) {
+			gotQuery, gotArgs = query, args
+			return fakeJobsResult{affected: 1}, nil
+		},
+	}
+	d := newFakeJobsDB(t, conn)
+	if err := d.markJobRunning(42); err != nil {
+		t.Fatalf("markJobRunning: %v", err)
+	}
+	if len(gotArgs) != 2 || gotArgs[1].Value != int64(42) {
+		t.Fatalf("markJobRunning args = %v, want job id 42 as the second param", gotArgs)
+	}
+	if gotArgs[0].Value != jobStateRunning {
+		t.Fatalf("markJobRunning state = %v, want %q", gotArgs[0].Value, jobStateRunning)
+	}
+	_ = gotQuery
+}
+
+func TestMarkJobFailed(t *testing.T) {
+	var gotArgs []driver.NamedValue
+	conn := &fakeJobsConn{
+		execFn: func(query string, args []driver.NamedValue) (driver.Result, error) {
+			gotArgs = args
+			return fakeJobsResult{affected: 1}, nil
+		},
+	}
+	d := newFakeJobsDB(t, conn)
+	if err := d.markJobFailed(7, errors.New("boom")); err != nil {
+		t.Fatalf("markJobFailed: %v", err)
+	}
+	if len(gotArgs) != 3 {
+		t.Fatalf("markJobFailed args = %v, want 3 params", gotArgs)
+	}
+	if gotArgs[0].Value != jobStateFailed {
+		t.Errorf("state = %v, want %q", gotArgs[0].Value, jobStateFailed)
+	}
+	if gotArgs[1].Value != "boom" {
+		t.Errorf("error = %v, want %q", gotArgs[1].Value, "boom")
+	}
+	if gotArgs[2].Value != int64(7) {
+		t.Errorf("id = %v, want 7", gotArgs[2].Value)
+	}
+}
+
+func TestResumableImportJobs(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	var gotArgs []driver.NamedValue
+	conn := &fakeJobsConn{
+		queryFn: func(query string, args []driver.NamedValue) (driver.Rows, error) {
+			gotArgs = args
+			return &fakeJobRows{rows: [][]driver.Value{
+				{int64(1), "archive.zip", jobStateRunning, int64(3), int64(1), int64(0), int64(0), "", now, nil},
+			}}, nil
+		},
+	}
+	d := newFakeJobsDB(t, conn)
+	jobs, err := d.resumableImportJobs()
+	if err != nil {
+		t.Fatalf("resumableImportJobs: %v", err)
+	}
+	if len(gotArgs) != 1 || gotArgs[0].Value != jobStateRunning {
+		t.Fatalf("resumableImportJobs should filter on state = %q, got args %v", jobStateRunning, gotArgs)
+	}
+	if len(jobs) != 1 || jobs[0].ID != 1 || jobs[0].State != jobStateRunning {
+		t.Fatalf("resumableImportJobs = %+v, want one running job with id 1", jobs)
+	}
+	if jobs[0].FinishedAt != nil {
+		t.Errorf("FinishedAt = %v, want nil for a still-running job", jobs[0].FinishedAt)
+	}
+}
+
+func TestJobFilename(t *testing.T) {
+	if got, want := jobFilename(5, "archive.zip"), "5-archive.zip"; got != want {
+		t.Errorf("jobFilename(5, %q) = %q, want %q", "archive.zip", got, want)
+	}
+	// filepath.Base strips any directory component a client-supplied
+	// filename might carry, so a crafted upload can't escape uploadsDir.
+	if got, want := jobFilename(5, "../../etc/passwd"), "5-passwd"; got != want {
+		t.Errorf("jobFilename(5, %q) = %q, want %q", "../../etc/passwd", got, want)
+	}
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"archive/zip"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const mediaSql = `
+create table media (
+	id serial primary key,
+	tweet_id bigint references tweets(id),
+	url text,
+	local_path text not null,
+	content_type text,
+	sha256 bytea not null,
+	width integer,
+	height integer,
+	unique (tweet_id, sha256)
+);
+
+create index on media (tweet_id);
+`
+
+func (d *DB) createMediaTable() error {
+	tx, err := d.conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Commit()
+	_, err = tx.Exec(mediaSql)
+	return err
+}
+
+// mediaDir is where archived media content is stored, named by its sha256
+// hex digest, so the same image or video bundled or fetched more than once
+// is only ever stored on disk once.
+var mediaDir = "./media"
+
+// fetchMedia controls whether archiveTweetMedia reaches out to the network
+// for entities.media URLs that weren't bundled in the archive itself.
+var fetchMedia = false
+
+func shaHex(sum [32]byte) string {
+	return fmt.Sprintf("%x", sum)
+}
+
+// storeMedia writes b to mediaDir, content-addressed by its sha256, and
+// records it against tweetID. Storing is idempotent: re-archiving the same
+// content for the same tweet, as happens when a crashed import job is
+// resumed, is a no-op thanks to the media table's (tweet_id, sha256)
+// uniqueness.
+func (d *DB) storeMedia(tweetID int64, url string, b []byte) error {
+	sum := sha256.Sum256(b)
+	path := filepath.Join(mediaDir, shaHex(sum))
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		if err := os.WriteFile(path, b, 0644); err != nil {
+			return err
+		}
+	}
+	contentType := http.DetectContentType(b)
+	_, err := d.conn.Exec(
+		`insert into media (tweet_id, url, local_path, content_type, sha256) values ($1, $2, $3, $4, $5)
+		 on conflict (tweet_id, sha256) do nothing`,
+		tweetID, url, path, contentType, sum[:])
+	return err
+}
+
+const mediaFetchWorkers = 4
+const mediaFetchInterval = 200 * time.Millisecond
+
+type mediaFetchJob struct {
+	tweetID int64
+	url     string
+}
+
+var mediaFetchQueue = make(chan mediaFetchJob, 1000)
+
+// startMediaFetchWorkers launches a bounded pool of goroutines that fetch
+// queued media URLs no faster than mediaFetchInterval apart, so importing
+// an archive with --fetch-media doesn't hammer whatever's still hosting the
+// original images.
+func startMediaFetchWorkers() {
+	limiter := time.NewTicker(mediaFetchInterval)
+	for i := 0; i < mediaFetchWorkers; i++ {
+		go func() {
+			for job := range mediaFetchQueue {
+				<-limiter.C
+				if err := fetchAndStoreMedia(job.tweetID, job.url); err != nil {
+					log.Println("media: fetching", job.url, "-", err)
+				}
+			}
+		}()
+	}
+}
+
+func fetchAndStoreMedia(tweetID int64, url string) error {
+	resp, err := http.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("media: fetching %s: %s", url, resp.Status)
+	}
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	return db.storeMedia(tweetID, url, b)
+}
+
+// enqueueMediaFetch queues url for background fetch and storage against
+// tweetID. A no-op unless --fetch-media is set.
+func enqueueMediaFetch(tweetID int64, url string) {
+	if !fetchMedia {
+		return
+	}
+	select {
+	case mediaFetchQueue <- mediaFetchJob{tweetID, url}:
+	default:
+		log.Println("media: fetch queue full, dropping", url)
+	}
+}
+
+const tweetMediaGlob = `data/js/tweet_media/*`
+
+// bundledMediaByTweet indexes a legacy archive's data/js/tweet_media files
+// by the tweet id Twitter embeds at the front of their filenames
+// (<tweet_id>-<media_id>.<ext>).
+func bundledMediaByTweet(zr *zip.Reader) map[int64][]*zip.File {
+	out := make(map[int64][]*zip.File)
+	for _, f := range zr.File {
+		if matched, _ := filepath.Match(tweetMediaGlob, f.Name); !matched {
+			continue
+		}
+		base := filepath.Base(f.Name)
+		sep := strings.IndexByte(base, '-')
+		if sep <= 0 {
+			continue
+		}
+		id, err := strconv.ParseInt(base[:sep], 10, 64)
+		if err != nil {
+			continue
+		}
+		out[id] = append(out[id], f)
+	}
+	return out
+}
+
+// archiveTweetMedia stores whatever media goes with one tweet: files
+// bundled alongside it in the archive if there are any, or, failing that,
+// its entities.media URLs if --fetch-media is enabled.
+func archiveTweetMedia(db *DB, tweetID int64, t map[string]interface{}, bundled []*zip.File) {
+	if len(bundled) > 0 {
+		for _, f := range bundled {
+			b, err := readZipFile(f)
+			if err != nil {
+				log.Println("media: reading bundled", f.Name, "-", err)
+				continue
+			}
+			if err := db.storeMedia(tweetID, "", b); err != nil {
+				log.Println("media: storing bundled", f.Name, "-", err)
+			}
+		}
+		return
+	}
+	for _, url := range extractMediaURLs(t) {
+		enqueueMediaFetch(tweetID, url)
+	}
+}
+
+// MediaInfo is the JSON shape SearchHandler attaches to each matching
+// tweet, pointing at this archive's own copy of the media rather than the
+// original (and possibly now-dead) source URL.
+type MediaInfo struct {
+	URL         string `json:"url"`
+	ContentType string `json:"content_type"`
+}
+
+// mediaForTweets loads every archived media item belonging to any of ids,
+// grouped by tweet id, for SearchHandler to attach to its results.
+func (d *DB) mediaForTweets(ids []string) (map[string][]MediaInfo, error) {
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	b := &sqlBuilder{}
+	b.lit("select tweet_id::text, sha256, content_type from media where tweet_id in (")
+	for i, id := range ids {
+		if i > 0 {
+			b.lit(",")
+		}
+		b.arg(id)
+	}
+	b.lit(")")
+	rows, err := d.conn.Query(b.sql.String(), b.args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := make(map[string][]MediaInfo)
+	for rows.Next() {
+		var tweetID, contentType string
+		var sum []byte
+		if err := rows.Scan(&tweetID, &sum, &contentType); err != nil {
+			return nil, err
+		}
+		out[tweetID] = append(out[tweetID], MediaInfo{
+			URL:         "/media/" + fmt.Sprintf("%x", sum),
+			ContentType: contentType,
+		})
+	}
+	return out, rows.Err()
+}
+
+// MediaHandler serves back media archived by sha256 digest, with a
+// long-lived cache header since content-addressed media never changes
+// under a given URL.
+func MediaHandler(w http.ResponseWriter, r *http.Request) {
+	sum := strings.TrimPrefix(r.URL.Path, "/media/")
+	if sum == "" || strings.ContainsAny(sum, "/.") {
+		http.NotFound(w, r)
+		return
+	}
+	row := db.conn.QueryRow(
+		`select local_path, content_type from media where encode(sha256, 'hex') = $1 limit 1`, sum)
+	var path, contentType string
+	if err := row.Scan(&path, &contentType); err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	if contentType != "" {
+		w.Header().Set("Content-Type", contentType)
+	}
+	w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	http.ServeFile(w, r, path)
+}
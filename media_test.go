@@ -0,0 +1,47 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"testing"
+)
+
+func TestBundledMediaByTweet(t *testing.T) {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	files := []string{
+		"data/js/tweet_media/123-abc.jpg",
+		"data/js/tweet_media/123-def.jpg",
+		"data/js/tweet_media/456-ghi.mp4",
+		"data/js/tweet_media/not-a-tweet-id.jpg",
+		"data/js/other_file.js",
+	}
+	for _, name := range files {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatalf("zw.Create(%q): %v", name, err)
+		}
+		if _, err := w.Write([]byte("x")); err != nil {
+			t.Fatalf("writing %q: %v", name, err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatalf("zw.Close: %v", err)
+	}
+
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatalf("zip.NewReader: %v", err)
+	}
+
+	byTweet := bundledMediaByTweet(zr)
+	if len(byTweet[123]) != 2 {
+		t.Errorf("byTweet[123] = %d files, want 2", len(byTweet[123]))
+	}
+	if len(byTweet[456]) != 1 {
+		t.Errorf("byTweet[456] = %d files, want 1", len(byTweet[456]))
+	}
+	if _, ok := byTweet[0]; ok {
+		t.Error("a media filename with no parseable leading tweet id should be skipped, not bucketed under 0")
+	}
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// micropubEntry is a parsed h-entry, independent of whether it arrived as a
+// form-encoded or JSON Micropub request.
+type micropubEntry struct {
+	content    string
+	categories []string
+	inReplyTo  sql.NullInt64
+	lon, lat   float64
+	hasGeo     bool
+	raw        interface{}
+}
+
+// MicropubHandler implements the create half of the Micropub server spec
+// (https://micropub.spec.indieweb.org/): POSTing an h-entry inserts it into
+// the tweets table as though it had been archived from Twitter, so IndieWeb
+// clients like Quill or Indigenous can publish straight into the archive.
+// GET handles the q=config/source/syndicate-to queries clients use to
+// discover what the endpoint supports.
+func MicropubHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "GET" {
+		micropubQueryHandler(w, r)
+		return
+	}
+	scope, err := verifyMicropubToken(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	if !hasScope(scope, "create") {
+		http.Error(w, "micropub: token missing create scope", http.StatusForbidden)
+		return
+	}
+	entry, err := parseMicropubEntry(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	id, err := db.insertMicropubEntry(entry)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	w.Header().Set("Location", micropubPermalink(id))
+	w.WriteHeader(http.StatusCreated)
+}
+
+func micropubQueryHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.FormValue("q") {
+	case "config":
+		writeMicropubJSON(w, map[string]interface{}{"syndicate-to": []interface{}{}})
+	case "syndicate-to":
+		writeMicropubJSON(w, map[string]interface{}{"syndicate-to": []interface{}{}})
+	case "source":
+		entry, err := db.micropubSource(r.FormValue("url"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		writeMicropubJSON(w, entry)
+	default:
+		http.Error(w, "micropub: unsupported query", http.StatusBadRequest)
+	}
+}
+
+func writeMicropubJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+// verifyMicropubToken confirms r carries a bearer token the configured
+// IndieAuth token endpoint recognizes, and returns the scope it was issued
+// with.
+func verifyMicropubToken(r *http.Request) (string, error) {
+	token := r.FormValue("access_token")
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		token = strings.TrimPrefix(auth, "Bearer ")
+	}
+	if token == "" {
+		return "", fmt.Errorf("micropub: missing bearer token")
+	}
+	req, err := http.NewRequest("GET", *tokenEndpoint, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Accept", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("micropub: token endpoint rejected token: %s", resp.Status)
+	}
+	var result struct {
+		Me    string `json:"me"`
+		Scope string `json:"scope"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", err
+	}
+	if result.Scope == "" {
+		return "", fmt.Errorf("micropub: token endpoint response missing scope")
+	}
+	if *micropubMe == "" {
+		return "", fmt.Errorf("micropub: server has no -micropub-me configured, refusing all tokens")
+	}
+	if strings.TrimRight(result.Me, "/") != strings.TrimRight(*micropubMe, "/") {
+		return "", fmt.Errorf("micropub: token was issued to %q, not this archive's owner", result.Me)
+	}
+	return result.Scope, nil
+}
+
+func hasScope(scopes, want string) bool {
+	for _, s := range strings.Fields(scopes) {
+		if s == want {
+			return true
+		}
+	}
+	return false
+}
+
+func parseMicropubEntry(r *http.Request) (*micropubEntry, error) {
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		return parseMicropubJSON(r)
+	}
+	return parseMicropubForm(r)
+}
+
+func parseMicropubForm(r *http.Request) (*micropubEntry, error) {
+	if err := r.ParseMultipartForm(10 << 20); err != nil && err != http.ErrNotMultipart {
+		return nil, err
+	}
+	if h := r.FormValue("h"); h != "" && h != "entry" {
+		return nil, fmt.Errorf("micropub: unsupported entry type %q", h)
+	}
+	e := &micropubEntry{
+		content:    r.FormValue("content"),
+		categories: r.Form["category[]"],
+	}
+	if len(e.categories) == 0 && r.FormValue("category") != "" {
+		e.categories = strings.Split(r.FormValue("category"), ",")
+	}
+	e.inReplyTo = parseInReplyTo(r.FormValue("in-reply-to"))
+	if loc := r.FormValue("location"); loc != "" {
+		e.lon, e.lat, e.hasGeo = parseGeoURI(loc)
+	}
+	raw := make(map[string]interface{}, len(r.Form))
+	for k, v := range r.Form {
+		if len(v) == 1 {
+			raw[k] = v[0]
+		} else {
+			raw[k] = v
+		}
+	}
+	e.raw = raw
+	return e, nil
+}
+
+func parseMicropubJSON(r *http.Request) (*micropubEntry, error) {
+	var payload struct {
+		Type       []string                 `json:"type"`
+		Properties map[string][]interface{} `json:"properties"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		return nil, err
+	}
+	e := &micropubEntry{}
+	if vals := payload.Properties["content"]; len(vals) > 0 {
+		e.content, _ = vals[0].(string)
+	}
+	for _, c := range payload.Properties["category"] {
+		if s, ok := c.(string); ok {
+			e.categories = append(e.categories, s)
+		}
+	}
+	if vals := payload.Properties["in-reply-to"]; len(vals) > 0 {
+		if s, ok := vals[0].(string); ok {
+			e.inReplyTo = parseInReplyTo(s)
+		}
+	}
+	if vals := payload.Properties["location"]; len(vals) > 0 {
+		if s, ok := vals[0].(string); ok {
+			e.lon, e.lat, e.hasGeo = parseGeoURI(s)
+		}
+	}
+	e.raw = payload
+	return e, nil
+}
+
+// parseInReplyTo recognizes in-reply-to URLs that point back at this
+// instance's own tweet permalinks, mapping them to the referenced tweet's
+// id. URLs pointing elsewhere are left unset: we have no tweet row to
+// reference.
+func parseInReplyTo(u string) sql.NullInt64 {
+	id, ok := tweetIDFromURL(u)
+	if !ok {
+		return sql.NullInt64{}
+	}
+	return sql.NullInt64{Int64: id, Valid: true}
+}
+
+func tweetIDFromURL(u string) (int64, bool) {
+	if u == "" || *micropubBaseURL == "" {
+		return 0, false
+	}
+	prefix := strings.TrimRight(*micropubBaseURL, "/") + "/tweet/"
+	if !strings.HasPrefix(u, prefix) {
+		return 0, false
+	}
+	id, err := strconv.ParseInt(strings.TrimPrefix(u, prefix), 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return id, true
+}
+
+// parseGeoURI parses a "geo:" URI (RFC 5870), as used by the Micropub
+// location property, into the (lon, lat) pair extractGeo also produces.
+func parseGeoURI(uri string) (lon, lat float64, ok bool) {
+	if !strings.HasPrefix(uri, "geo:") {
+		return 0, 0, false
+	}
+	coords := strings.SplitN(strings.TrimPrefix(uri, "geo:"), ";", 2)[0]
+	parts := strings.SplitN(coords, ",", 2)
+	if len(parts) != 2 {
+		return 0, 0, false
+	}
+	latF, err1 := strconv.ParseFloat(strings.TrimSpace(parts[0]), 64)
+	lonF, err2 := strconv.ParseFloat(strings.TrimSpace(parts[1]), 64)
+	if err1 != nil || err2 != nil {
+		return 0, 0, false
+	}
+	return lonF, latF, true
+}
+
+func micropubPermalink(id int64) string {
+	return strings.TrimRight(*micropubBaseURL, "/") + "/tweet/" + strconv.FormatInt(id, 10)
+}
+
+// insertMicropubEntry stamps e with a synthetic, time-ordered id and
+// inserts it through the same buildTweetRow path every other Importer
+// uses, so search, hashtags and geo all work on Micropub posts exactly as
+// they do on archived tweets. The original Micropub payload is preserved
+// under the "micropub" key, stored into full_tweet. q=source does not read
+// it: micropubSource rebuilds the post from the text and hashtags columns.
+func (d *DB) insertMicropubEntry(e *micropubEntry) (int64, error) {
+	id := time.Now().UnixNano()
+	t := map[string]interface{}{
+		"id_str":     strconv.FormatInt(id, 10),
+		"created_at": time.Now().UTC().Format(time.RFC3339),
+		"text":       e.content,
+		"micropub":   e.raw,
+	}
+	if len(e.categories) > 0 {
+		hashtags := make([]interface{}, len(e.categories))
+		for i, c := range e.categories {
+			hashtags[i] = map[string]interface{}{"text": c}
+		}
+		t["entities"] = map[string]interface{}{"hashtags": hashtags}
+	}
+	if e.inReplyTo.Valid {
+		t["in_reply_to_status_id_str"] = strconv.FormatInt(e.inReplyTo.Int64, 10)
+	}
+	if e.hasGeo {
+		t["coordinates"] = map[string]interface{}{
+			"coordinates": []interface{}{e.lon, e.lat},
+		}
+	}
+	if _, err := d.insertTweets([]interface{}{t}); err != nil {
+		return 0, err
+	}
+	return id, nil
+}
+
+// micropubSource reconstructs the mf2 properties of a previously-published
+// tweet, for Micropub's q=source query.
+func (d *DB) micropubSource(permalink string) (map[string]interface{}, error) {
+	id, ok := tweetIDFromURL(permalink)
+	if !ok {
+		return nil, fmt.Errorf("micropub: url does not reference a tweet on this instance")
+	}
+	row := d.conn.QueryRow(
+		`select text, array_to_string(hashtags, ',') from tweets where id = $1`, id)
+	var text, hashtagsCSV string
+	if err := row.Scan(&text, &hashtagsCSV); err != nil {
+		return nil, err
+	}
+	props := map[string]interface{}{"content": []string{text}}
+	if hashtagsCSV != "" {
+		props["category"] = strings.Split(hashtagsCSV, ",")
+	}
+	return map[string]interface{}{"type": []string{"h-entry"}, "properties": props}, nil
+}
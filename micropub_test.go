@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// withTokenEndpoint points the package-level tokenEndpoint/micropubMe flags
+// at a test token endpoint for the duration of a test, restoring the
+// previous values afterward.
+func withTokenEndpoint(t *testing.T, handler http.HandlerFunc, me string) {
+	t.Helper()
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+
+	prevEndpoint, prevMe := *tokenEndpoint, *micropubMe
+	*tokenEndpoint = srv.URL
+	*micropubMe = me
+	t.Cleanup(func() {
+		*tokenEndpoint = prevEndpoint
+		*micropubMe = prevMe
+	})
+}
+
+func tokenRequest(t *testing.T, token string) *http.Request {
+	t.Helper()
+	r, err := http.NewRequest("POST", "/micropub", nil)
+	if err != nil {
+		t.Fatalf("NewRequest: %v", err)
+	}
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	return r
+}
+
+func TestVerifyMicropubToken(t *testing.T) {
+	t.Run("accepts the configured owner", func(t *testing.T) {
+		withTokenEndpoint(t, func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, `{"me":"https://owner.example/","scope":"create"}`)
+		}, "https://owner.example/")
+
+		scope, err := verifyMicropubToken(tokenRequest(t, "tok"))
+		if err != nil {
+			t.Fatalf("verifyMicropubToken: %v", err)
+		}
+		if scope != "create" {
+			t.Errorf("scope = %q, want %q", scope, "create")
+		}
+	})
+
+	t.Run("rejects a token issued to someone else", func(t *testing.T) {
+		withTokenEndpoint(t, func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, `{"me":"https://someone-else.example/","scope":"create"}`)
+		}, "https://owner.example/")
+
+		if _, err := verifyMicropubToken(tokenRequest(t, "tok")); err == nil {
+			t.Fatal("verifyMicropubToken should reject a token whose me doesn't match -micropub-me")
+		}
+	})
+
+	t.Run("rejects any token when no owner is configured", func(t *testing.T) {
+		withTokenEndpoint(t, func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, `{"me":"https://owner.example/","scope":"create"}`)
+		}, "")
+
+		if _, err := verifyMicropubToken(tokenRequest(t, "tok")); err == nil {
+			t.Fatal("verifyMicropubToken should refuse every token when -micropub-me is unset")
+		}
+	})
+
+	t.Run("ignores a trailing slash mismatch", func(t *testing.T) {
+		withTokenEndpoint(t, func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, `{"me":"https://owner.example","scope":"create"}`)
+		}, "https://owner.example/")
+
+		if _, err := verifyMicropubToken(tokenRequest(t, "tok")); err != nil {
+			t.Fatalf("verifyMicropubToken should treat a trailing slash as equivalent: %v", err)
+		}
+	})
+
+	t.Run("rejects a missing bearer token", func(t *testing.T) {
+		withTokenEndpoint(t, func(w http.ResponseWriter, r *http.Request) {
+			t.Fatal("token endpoint should not be contacted with no token present")
+		}, "https://owner.example/")
+
+		if _, err := verifyMicropubToken(tokenRequest(t, "")); err == nil {
+			t.Fatal("verifyMicropubToken should reject a request with no bearer token")
+		}
+	})
+
+	t.Run("rejects a token the endpoint doesn't recognize", func(t *testing.T) {
+		withTokenEndpoint(t, func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+		}, "https://owner.example/")
+
+		if _, err := verifyMicropubToken(tokenRequest(t, "tok")); err == nil {
+			t.Fatal("verifyMicropubToken should reject a token the endpoint rejected")
+		}
+	})
+}
+
+func TestHasScope(t *testing.T) {
+	if !hasScope("create update", "create") {
+		t.Error(`hasScope("create update", "create") = false, want true`)
+	}
+	if hasScope("update delete", "create") {
+		t.Error(`hasScope("update delete", "create") = true, want false`)
+	}
+	if hasScope("", "create") {
+		t.Error(`hasScope("", "create") = true, want false`)
+	}
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+type Tweet struct {
+	ID        string      `json:"id"`
+	Text      string      `json:"text"`
+	Timestamp time.Time   `json:"timestamp"`
+	Media     []MediaInfo `json:"media,omitempty"`
+}
+
+// BoundingBox restricts a search to tweets whose geog falls within it.
+type BoundingBox struct {
+	MinLon, MinLat, MaxLon, MaxLat float64
+}
+
+// SearchFilters narrows a Search beyond the full-text query, using the
+// columns insertTweets populates: hashtags, user_mentions, geog and
+// created_at, plus the media table for HasMedia.
+type SearchFilters struct {
+	Hashtag  string
+	Mention  string
+	HasGeo   bool
+	HasMedia bool
+	Since    time.Time
+	Until    time.Time
+	BBox     *BoundingBox
+}
+
+func (f SearchFilters) empty() bool {
+	return f.Hashtag == "" && f.Mention == "" && !f.HasGeo && !f.HasMedia &&
+		f.Since.IsZero() && f.Until.IsZero() && f.BBox == nil
+}
+
+// parseSearchFilters reads hashtag, mention, has_geo, has_media, since,
+// until and bbox query string parameters into a SearchFilters.
+func parseSearchFilters(r *http.Request) (SearchFilters, error) {
+	var f SearchFilters
+	f.Hashtag = r.FormValue("hashtag")
+	f.Mention = r.FormValue("mention")
+	f.HasGeo, _ = strconv.ParseBool(r.FormValue("has_geo"))
+	f.HasMedia, _ = strconv.ParseBool(r.FormValue("has_media"))
+	if since := r.FormValue("since"); since != "" {
+		t, err := time.Parse("2006-01-02", since)
+		if err != nil {
+			return f, err
+		}
+		f.Since = t
+	}
+	if until := r.FormValue("until"); until != "" {
+		t, err := time.Parse("2006-01-02", until)
+		if err != nil {
+			return f, err
+		}
+		f.Until = t
+	}
+	if bbox := r.FormValue("bbox"); bbox != "" {
+		var b BoundingBox
+		n, err := fmt.Sscanf(bbox, "%f,%f,%f,%f", &b.MinLon, &b.MinLat, &b.MaxLon, &b.MaxLat)
+		if err != nil || n != 4 {
+			return f, fmt.Errorf("tweetarchive: bbox must be \"minlon,minlat,maxlon,maxlat\"")
+		}
+		f.BBox = &b
+	}
+	return f, nil
+}
+
+// Search runs a full-text query, an attribute filter, or both, returning
+// matching tweets most relevant (if there was a query) or most recent first.
+func Search(query string, filters SearchFilters) (tweets []*Tweet, e error) {
+	b := &sqlBuilder{}
+	headline := "text"
+	if query != "" {
+		headline = "ts_headline('english', text, q, 'HighlightAll=TRUE')"
+	}
+	b.lit("select id::text, text, " + headline + ", created_at from tweets")
+	if query != "" {
+		b.lit(", plainto_tsquery('english', ")
+		b.arg(query)
+		b.lit(") q")
+	}
+	var where []string
+	if query != "" {
+		where = append(where, "tsv @@ q")
+	}
+	if filters.Hashtag != "" {
+		where = append(where, "$"+strconv.Itoa(b.push(filters.Hashtag))+" = any(hashtags)")
+	}
+	if filters.Mention != "" {
+		where = append(where, "$"+strconv.Itoa(b.push(filters.Mention))+" = any(user_mentions)")
+	}
+	if filters.HasGeo {
+		where = append(where, "geog is not null")
+	}
+	if filters.HasMedia {
+		where = append(where, "exists (select 1 from media m where m.tweet_id = tweets.id)")
+	}
+	if !filters.Since.IsZero() {
+		where = append(where, "created_at >= $"+strconv.Itoa(b.push(filters.Since)))
+	}
+	if !filters.Until.IsZero() {
+		where = append(where, "created_at <= $"+strconv.Itoa(b.push(filters.Until)))
+	}
+	if filters.BBox != nil {
+		minLon := b.push(filters.BBox.MinLon)
+		minLat := b.push(filters.BBox.MinLat)
+		maxLon := b.push(filters.BBox.MaxLon)
+		maxLat := b.push(filters.BBox.MaxLat)
+		where = append(where, fmt.Sprintf(
+			"ST_Within(geog::geometry, ST_MakeEnvelope($%d,$%d,$%d,$%d,4326))",
+			minLon, minLat, maxLon, maxLat))
+	}
+	for i, cond := range where {
+		if i == 0 {
+			b.lit(" where ")
+		} else {
+			b.lit(" and ")
+		}
+		b.lit(cond)
+	}
+	if query != "" {
+		b.lit(" order by ts_rank_cd(tsv, q) desc")
+	} else {
+		b.lit(" order by created_at desc")
+	}
+
+	rows, err := db.conn.Query(b.sql.String(), b.args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		tweet := &Tweet{}
+		var headline string
+		if err := rows.Scan(&tweet.ID, &tweet.Text, &headline, &tweet.Timestamp); err != nil {
+			return nil, err
+		}
+		tweets = append(tweets, tweet)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	ids := make([]string, len(tweets))
+	for i, tweet := range tweets {
+		ids[i] = tweet.ID
+	}
+	media, err := db.mediaForTweets(ids)
+	if err != nil {
+		return nil, err
+	}
+	for _, tweet := range tweets {
+		tweet.Media = media[tweet.ID]
+	}
+	return tweets, nil
+}
+
+func SearchHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.FormValue("q")
+	filters, err := parseSearchFilters(r)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	var tweets []*Tweet
+	if q != "" || !filters.empty() {
+		log.Print(q)
+		tweets, err = Search(q, filters)
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	b, err := json.Marshal(struct {
+		Tweets []*Tweet `json:"tweets"`
+	}{tweets})
+	if err != nil {
+		log.Println("couldn't marshal JSON search results", err)
+	}
+	w.Write(b)
+}
@@ -18,131 +18,24 @@
 package main
 
 import (
-	"archive/zip"
-	"bytes"
+	"context"
 	"database/sql"
-	"encoding/json"
 	"flag"
 	"fmt"
-	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
-	"path/filepath"
-	"strconv"
-	"time"
 
 	"bitbucket.org/tebeka/nrsc"
 
 	_ "github.com/bmizerany/pq"
-)
-
-type Tweet struct {
-	ID        string    `json:"id"`
-	Text      string    `json:"text"`
-	Timestamp time.Time `json:"timestamp"`
-}
 
-const ftsSql = `
-select id::text, text, ts_headline('english', text, q, 'HighlightAll=TRUE'), created_at
-from tweets, plainto_tsquery('english', $1) q
-where tsv @@ q order by ts_rank_cd(tsv, q) desc;
-`
+	"github.com/rudimk/tweetarchive/activitypub"
+)
 
 var db *DB
-
-func Search(query string) (tweets []*Tweet, e error) {
-	rows, err := db.conn.Query(ftsSql, query)
-	if err != nil {
-		return nil, err
-	}
-	for rows.Next() {
-		tweet := &Tweet{}
-		var headline string
-		err = rows.Scan(&tweet.ID, &tweet.Text, &headline, &tweet.Timestamp)
-		if err != nil {
-			return nil, err
-		}
-		tweets = append(tweets, tweet)
-	}
-	return tweets, nil
-}
-
-func SearchHandler(w http.ResponseWriter, r *http.Request) {
-	var (
-		tweets []*Tweet
-		err    error
-	)
-	q := r.FormValue("q")
-	if q != "" {
-		log.Print(q)
-		tweets, err = Search(q)
-		if err != nil {
-			http.Error(w, err.Error(), 500)
-			return
-		}
-	}
-	w.Header().Set("Content-Type", "application/json")
-	b, err := json.Marshal(struct {
-		Tweets []*Tweet `json:"tweets"`
-	}{tweets})
-	if err != nil {
-		log.Println("couldn't marshal JSON search results", err)
-	}
-	w.Write(b)
-}
-
-type Archive struct {
-	Reader *zip.Reader
-}
-
-func NewArchive(r io.Reader) (*Archive, error) {
-	var b bytes.Buffer
-	_, err := io.Copy(&b, r)
-	if err != nil {
-		return nil, err
-	}
-	brdr := bytes.NewReader(b.Bytes())
-	zrdr, err := zip.NewReader(brdr, int64(brdr.Len()))
-	if err != nil {
-		return nil, err
-	}
-	return &Archive{zrdr}, nil
-}
-
-const tweetJsonGlob = `data/js/tweets/????_??.js`
-
-// Tests if this is a valid tweet archive, as it looked downloaded from Twitter
-func (a *Archive) Valid() bool {
-	paths := make(map[string]bool)
-	for _, f := range a.Reader.File {
-		paths[f.Name] = true
-	}
-	expected := []string{
-		"data/js/tweet_index.js",
-		"data/js/user_details.js",
-		"data/js/payload_details.js",
-	}
-	for _, path := range expected {
-		if !paths[path] {
-			log.Printf("expected %s in zip file", path)
-			return false
-		}
-	}
-	foundTweets := false
-	for path, _ := range paths {
-		if matched, _ := filepath.Match(tweetJsonGlob, path); matched {
-			foundTweets = true
-			break
-		}
-	}
-	if !foundTweets {
-		log.Printf("expected to find at least one tweets JSON file in zip archive")
-		return false
-	}
-	return true
-}
+var ap *activitypub.Server
 
 type DB struct {
 	conn *sql.DB
@@ -157,8 +50,8 @@ func newDb(name, host string, port int) (*DB, error) {
 	return &DB{conn}, nil
 }
 
-func (d *DB) tableExists() bool {
-	row := d.conn.QueryRow("select true from pg_tables where tablename = 'tweets'")
+func (d *DB) tableExists(name string) bool {
+	row := d.conn.QueryRow("select true from pg_tables where tablename = $1", name)
 	var found bool
 	if err := row.Scan(&found); err != nil {
 		return false
@@ -181,93 +74,21 @@ func (d *DB) createTable() error {
 	return nil
 }
 
-func (d *DB) insertTweets(tweets []interface{}) error {
-	tx, err := d.conn.Begin()
-	if err != nil {
-		return err
-	}
-	defer tx.Commit()
-	stmt, err := d.conn.Prepare(insertSql)
-	if err != nil {
-		return err
-	}
-	for _, it := range tweets {
-		t := it.(map[string]interface{})
-		id, err := strconv.ParseInt(t["id_str"].(string), 10, 64)
-		if err != nil {
-			return err
-		}
-		_, err = stmt.Exec(
-			id,
-			t["created_at"].(string),
-			nil,
-			t["text"].(string),
-		)
-		if err != nil {
-			return err
-		}
-	}
-	return nil
-}
-
-const insertSql = `insert into tweets (id, created_at, geog, text) values ($1, $2, $3, $4)`
-
-func UploadHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method == "POST" {
-		// Check uploaded archive zipfile is valid
-		f, _, err := r.FormFile("zipfile")
-		if err != nil {
-			http.Error(w, err.Error(), 500)
-			return
-		}
-		archive, err := NewArchive(f)
-		if err != nil {
-			http.Error(w, err.Error(), 500)
-			return
-		}
-		if !archive.Valid() {
-			http.Error(w, "invalid tweet archive zipfile", 500)
-			return
-		}
-		for _, f := range archive.Reader.File {
-			if matched, _ := filepath.Match(tweetJsonGlob, f.Name); !matched {
-				continue
-			}
-			rc, err := f.Open()
-			defer rc.Close()
-			if err != nil {
-				http.Error(w, err.Error(), 500)
-				return
-			}
-			// Discard first line
-			var bb bytes.Buffer
-			io.Copy(&bb, rc)
-			b := make([]byte, bb.Len())
-			bb.Read(b)
-			index := bytes.Index(b, []byte("\n"))
-			var tweets interface{}
-			err = json.Unmarshal(b[index:len(b)], &tweets)
-			if err != nil {
-				http.Error(w, err.Error(), 500)
-				return
-			}
-			err = db.insertTweets(tweets.([]interface{}))
-			if err != nil {
-				http.Error(w, err.Error(), 500)
-				return
-			}
-		}
-		http.Redirect(w, r, "/", 302)
-	}
-	w.Write(uploadHtml)
-}
-
 var indexHtml, uploadHtml []byte
 
 var dbname = flag.String("dbname", "tweetarchive", "database name")
 var dbhost = flag.String("dbhost", "localhost", "database host")
 var dbport = flag.Int("dbport", 5432, "database port")
 var port = flag.Int("port", 13331, "web server port")
+var apBaseURL = flag.String("ap-base-url", "", "public base URL to serve this archive's ActivityPub actor from, e.g. https://archive.example.com (disabled if empty)")
+var apUsername = flag.String("ap-username", "archive", "username this archive's ActivityPub actor is followed as")
+var uploadsDirFlag = flag.String("uploads-dir", "./uploads", "directory uploaded archives are stored in while their import job runs")
+var importWorkers = flag.Int("import-workers", 2, "number of import jobs to run concurrently")
+var tokenEndpoint = flag.String("token-endpoint", "https://tokens.indieauth.com/token", "IndieAuth token endpoint used to verify Micropub bearer tokens")
+var micropubMe = flag.String("micropub-me", "", "the archive owner's IndieAuth \"me\" identity URL; Micropub tokens issued to any other identity are rejected (required to accept Micropub posts)")
+var micropubBaseURL = flag.String("micropub-base-url", "", "public base URL this archive is served from, used to build and recognize tweet permalinks for Micropub (disabled if empty)")
+var mediaDirFlag = flag.String("media-dir", "./media", "directory archived tweet media is stored in, content-addressed by sha256")
+var fetchMediaFlag = flag.Bool("fetch-media", false, "fetch tweet media not bundled in the archive over the network during import")
 
 func loadTemplate(name string, tvar *[]byte) {
 	rdr, err := nrsc.Get(name).Open()
@@ -289,17 +110,58 @@ func init() {
 		fmt.Fprintln(os.Stderr, "couldn't connect to the database:", err)
 		os.Exit(1)
 	}
-	if !db.tableExists() {
+	if !db.tableExists("tweets") {
 		log.Println("creating tweets table")
 		if err := db.createTable(); err != nil {
 			fmt.Fprintln(os.Stderr, "couldn't create the tweets table:", err)
 			os.Exit(1)
 		}
 	}
+	if !db.tableExists("import_jobs") {
+		log.Println("creating import_jobs table")
+		if err := db.createImportJobsTable(); err != nil {
+			fmt.Fprintln(os.Stderr, "couldn't create the import_jobs table:", err)
+			os.Exit(1)
+		}
+	}
+	if !db.tableExists("media") {
+		log.Println("creating media table")
+		if err := db.createMediaTable(); err != nil {
+			fmt.Fprintln(os.Stderr, "couldn't create the media table:", err)
+			os.Exit(1)
+		}
+	}
 
 	nrsc.Initialize()
 	loadTemplate("index.html", &indexHtml)
 	loadTemplate("upload.html", &uploadHtml)
+
+	uploadsDir = *uploadsDirFlag
+	if err := os.MkdirAll(uploadsDir, 0755); err != nil {
+		fmt.Fprintln(os.Stderr, "couldn't create the uploads directory:", err)
+		os.Exit(1)
+	}
+	startImportWorkers(*importWorkers)
+	resumeCrashedJobs()
+
+	mediaDir = *mediaDirFlag
+	if err := os.MkdirAll(mediaDir, 0755); err != nil {
+		fmt.Fprintln(os.Stderr, "couldn't create the media directory:", err)
+		os.Exit(1)
+	}
+	fetchMedia = *fetchMediaFlag
+	if fetchMedia {
+		startMediaFetchWorkers()
+	}
+
+	if *apBaseURL != "" {
+		ap, err = activitypub.New(db.conn, *apBaseURL, *apUsername)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "couldn't start the ActivityPub actor:", err)
+			os.Exit(1)
+		}
+		ap.Start(context.Background())
+	}
 }
 
 func main() {
@@ -308,7 +170,14 @@ func main() {
 	})
 	http.HandleFunc("/search", SearchHandler)
 	http.HandleFunc("/upload", UploadHandler)
+	http.HandleFunc("/jobs", JobsListHandler)
+	http.HandleFunc("/jobs/", JobHandler)
+	http.HandleFunc("/micropub", MicropubHandler)
+	http.HandleFunc("/media/", MediaHandler)
 	nrsc.Handle("/static/")
+	if ap != nil {
+		ap.RegisterHandlers(http.DefaultServeMux)
+	}
 	http.ListenAndServe(fmt.Sprintf(":%d", *port), nil)
 }
 
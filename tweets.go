@@ -0,0 +1,302 @@
+package main
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// tweetRow is the fully-parsed, column-shaped form of a raw tweet map,
+// ready to bind into an insert statement.
+type tweetRow struct {
+	id                int64
+	createdAt         string
+	lon, lat          float64
+	hasGeo            bool
+	text              string
+	isReply           bool
+	isRT              bool
+	inReplyToStatusID sql.NullInt64
+	hashtags          []string
+	userMentions      []string
+	fullTweet         []byte
+}
+
+// buildTweetRow extracts every column insertTweets knows how to populate out
+// of a raw tweet map, as produced by any Importer.
+func buildTweetRow(t map[string]interface{}) (*tweetRow, error) {
+	idStr, ok := t["id_str"].(string)
+	if !ok {
+		return nil, fmt.Errorf("tweet missing id_str")
+	}
+	id, err := strconv.ParseInt(idStr, 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	createdAt, ok := t["created_at"].(string)
+	if !ok {
+		return nil, fmt.Errorf("tweet %d missing created_at", id)
+	}
+	text, ok := t["text"].(string)
+	if !ok {
+		return nil, fmt.Errorf("tweet %d missing text", id)
+	}
+	full, err := json.Marshal(t)
+	if err != nil {
+		return nil, err
+	}
+	row := &tweetRow{
+		id:           id,
+		createdAt:    createdAt,
+		text:         text,
+		isRT:         isRetweet(t),
+		hashtags:     extractHashtags(t),
+		userMentions: extractMentions(t),
+		fullTweet:    full,
+	}
+	row.lon, row.lat, row.hasGeo = extractGeo(t)
+	if replyID, ok := t["in_reply_to_status_id_str"].(string); ok && replyID != "" {
+		parsed, err := strconv.ParseInt(replyID, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		row.isReply = true
+		row.inReplyToStatusID = sql.NullInt64{Int64: parsed, Valid: true}
+	}
+	return row, nil
+}
+
+// extractHashtags pulls entities.hashtags[*].text out of a raw tweet map.
+func extractHashtags(t map[string]interface{}) []string {
+	entities, _ := t["entities"].(map[string]interface{})
+	if entities == nil {
+		return nil
+	}
+	raw, _ := entities["hashtags"].([]interface{})
+	tags := make([]string, 0, len(raw))
+	for _, h := range raw {
+		hm, ok := h.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if text, ok := hm["text"].(string); ok && text != "" {
+			tags = append(tags, text)
+		}
+	}
+	return tags
+}
+
+// extractMentions pulls entities.user_mentions[*].screen_name out of a raw
+// tweet map.
+func extractMentions(t map[string]interface{}) []string {
+	entities, _ := t["entities"].(map[string]interface{})
+	if entities == nil {
+		return nil
+	}
+	raw, _ := entities["user_mentions"].([]interface{})
+	mentions := make([]string, 0, len(raw))
+	for _, m := range raw {
+		mm, ok := m.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if name, ok := mm["screen_name"].(string); ok && name != "" {
+			mentions = append(mentions, name)
+		}
+	}
+	return mentions
+}
+
+// extractMediaURLs pulls entities.media[*].media_url_https, and then the
+// top-level extended_entities.media[*].media_url_https, where Twitter put
+// the media entries for videos and GIFs, out of a raw tweet map. A URL
+// listed under both is returned twice.
+func extractMediaURLs(t map[string]interface{}) []string {
+	var urls []string
+	collect := func(container map[string]interface{}) {
+		raw, _ := container["media"].([]interface{})
+		for _, m := range raw {
+			mm, ok := m.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			if url, ok := mm["media_url_https"].(string); ok && url != "" {
+				urls = append(urls, url)
+			}
+		}
+	}
+	if entities, ok := t["entities"].(map[string]interface{}); ok {
+		collect(entities)
+	}
+	if extended, ok := t["extended_entities"].(map[string]interface{}); ok {
+		collect(extended)
+	}
+	return urls
+}
+
+// isRetweet reports whether a raw tweet map represents a retweet, either
+// because Twitter annotated it with a retweeted_status or, for older
+// archives that don't, because the text is a manual "RT @" retweet.
+func isRetweet(t map[string]interface{}) bool {
+	if _, ok := t["retweeted_status"]; ok {
+		return true
+	}
+	text, _ := t["text"].(string)
+	return strings.HasPrefix(text, "RT @")
+}
+
+// extractGeo converts a tweet's geo/coordinates fields into a (lon, lat)
+// pair. Twitter's older "geo" field is [lat, lon]; the GeoJSON
+// "coordinates" field that replaced it is [lon, lat].
+func extractGeo(t map[string]interface{}) (lon, lat float64, ok bool) {
+	if coords, ok2 := t["coordinates"].(map[string]interface{}); ok2 {
+		if arr, ok3 := coords["coordinates"].([]interface{}); ok3 && len(arr) == 2 {
+			lon, _ = arr[0].(float64)
+			lat, _ = arr[1].(float64)
+			return lon, lat, true
+		}
+	}
+	if geo, ok2 := t["geo"].(map[string]interface{}); ok2 {
+		if arr, ok3 := geo["coordinates"].([]interface{}); ok3 && len(arr) == 2 {
+			lat, _ = arr[0].(float64)
+			lon, _ = arr[1].(float64)
+			return lon, lat, true
+		}
+	}
+	return 0, 0, false
+}
+
+// pgTextArray implements driver.Valuer, encoding a []string as a Postgres
+// text[] array literal so it can be bound as a single query parameter.
+type pgTextArray []string
+
+func (a pgTextArray) Value() (driver.Value, error) {
+	if a == nil {
+		return nil, nil
+	}
+	parts := make([]string, len(a))
+	escaper := strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+	for i, s := range a {
+		parts[i] = `"` + escaper.Replace(s) + `"`
+	}
+	return "{" + strings.Join(parts, ",") + "}", nil
+}
+
+// sqlBuilder accumulates a parameterized query, numbering placeholders as
+// arguments are appended so callers don't have to track $N offsets by hand.
+type sqlBuilder struct {
+	sql  strings.Builder
+	args []interface{}
+}
+
+func (b *sqlBuilder) lit(s string) {
+	b.sql.WriteString(s)
+}
+
+func (b *sqlBuilder) arg(v interface{}) {
+	b.sql.WriteString("$" + strconv.Itoa(b.push(v)))
+}
+
+// push appends v to the argument list and returns its placeholder number,
+// without writing anything to the accumulated SQL text. Useful when a
+// placeholder's position in the query isn't known until later, such as
+// conditions collected into a WHERE clause.
+func (b *sqlBuilder) push(v interface{}) int {
+	b.args = append(b.args, v)
+	return len(b.args)
+}
+
+const maxInsertBatch = 500
+
+// insertTweets inserts tweets, a slice of raw tweet maps as produced by an
+// Importer, batching rows into multi-row INSERTs to keep round trips down
+// on large archives. Rows that already exist are skipped, so re-running an
+// import (e.g. to resume one that crashed partway through) is safe. It
+// returns how many rows were actually inserted.
+func (d *DB) insertTweets(tweets []interface{}) (int, error) {
+	tx, err := d.conn.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Commit()
+	rows := make([]*tweetRow, 0, len(tweets))
+	for _, it := range tweets {
+		row, err := buildTweetRow(it.(map[string]interface{}))
+		if err != nil {
+			return 0, err
+		}
+		rows = append(rows, row)
+	}
+	inserted := 0
+	for start := 0; start < len(rows); start += maxInsertBatch {
+		end := start + maxInsertBatch
+		if end > len(rows) {
+			end = len(rows)
+		}
+		n, err := insertTweetBatch(tx, rows[start:end])
+		if err != nil {
+			return inserted, err
+		}
+		inserted += n
+	}
+	return inserted, nil
+}
+
+func insertTweetBatch(tx *sql.Tx, rows []*tweetRow) (int, error) {
+	if len(rows) == 0 {
+		return 0, nil
+	}
+	b := &sqlBuilder{}
+	b.lit(`insert into tweets (id, created_at, geog, text, is_reply, is_rt, in_reply_to_status_id, hashtags, user_mentions, full_tweet) values `)
+	for i, row := range rows {
+		if i > 0 {
+			b.lit(", ")
+		}
+		b.lit("(")
+		b.arg(row.id)
+		b.lit(", ")
+		b.arg(row.createdAt)
+		b.lit(", ")
+		if row.hasGeo {
+			b.lit("ST_SetSRID(ST_MakePoint(")
+			b.arg(row.lon)
+			b.lit(",")
+			b.arg(row.lat)
+			b.lit("),4326)")
+		} else {
+			b.lit("NULL")
+		}
+		b.lit(", ")
+		b.arg(row.text)
+		b.lit(", ")
+		b.arg(row.isReply)
+		b.lit(", ")
+		b.arg(row.isRT)
+		b.lit(", ")
+		if row.inReplyToStatusID.Valid {
+			b.arg(row.inReplyToStatusID.Int64)
+		} else {
+			b.lit("NULL")
+		}
+		b.lit(", ")
+		b.arg(pgTextArray(row.hashtags))
+		b.lit(", ")
+		b.arg(pgTextArray(row.userMentions))
+		b.lit(", ")
+		b.arg(string(row.fullTweet))
+		b.lit(")")
+	}
+	b.lit(" on conflict (id) do nothing")
+	res, err := tx.Exec(b.sql.String(), b.args...)
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	return int(n), nil
+}
@@ -0,0 +1,111 @@
+package main
+
+import "testing"
+
+func TestBuildTweetRow(t *testing.T) {
+	t.Run("happy path", func(t *testing.T) {
+		tweet := map[string]interface{}{
+			"id_str":     "123",
+			"created_at": "Mon Jan 02 15:04:05 +0000 2006",
+			"text":       "hello #world, cc @friend",
+			"entities": map[string]interface{}{
+				"hashtags": []interface{}{
+					map[string]interface{}{"text": "world"},
+				},
+				"user_mentions": []interface{}{
+					map[string]interface{}{"screen_name": "friend"},
+				},
+			},
+		}
+		row, err := buildTweetRow(tweet)
+		if err != nil {
+			t.Fatalf("buildTweetRow: %v", err)
+		}
+		if row.id != 123 {
+			t.Errorf("id = %d, want 123", row.id)
+		}
+		if len(row.hashtags) != 1 || row.hashtags[0] != "world" {
+			t.Errorf("hashtags = %v, want [world]", row.hashtags)
+		}
+		if len(row.userMentions) != 1 || row.userMentions[0] != "friend" {
+			t.Errorf("userMentions = %v, want [friend]", row.userMentions)
+		}
+	})
+
+	t.Run("missing id_str", func(t *testing.T) {
+		_, err := buildTweetRow(map[string]interface{}{
+			"created_at": "Mon Jan 02 15:04:05 +0000 2006",
+			"text":       "hello",
+		})
+		if err == nil {
+			t.Fatal("buildTweetRow with no id_str should error, not panic")
+		}
+	})
+
+	t.Run("missing created_at", func(t *testing.T) {
+		_, err := buildTweetRow(map[string]interface{}{
+			"id_str": "123",
+			"text":   "hello",
+		})
+		if err == nil {
+			t.Fatal("buildTweetRow with no created_at should error, not panic")
+		}
+	})
+
+	t.Run("missing text", func(t *testing.T) {
+		_, err := buildTweetRow(map[string]interface{}{
+			"id_str":     "123",
+			"created_at": "Mon Jan 02 15:04:05 +0000 2006",
+		})
+		if err == nil {
+			t.Fatal("buildTweetRow with no text should error, not panic")
+		}
+	})
+
+	t.Run("null fields", func(t *testing.T) {
+		_, err := buildTweetRow(map[string]interface{}{
+			"id_str":     "123",
+			"created_at": nil,
+			"text":       "hello",
+		})
+		if err == nil {
+			t.Fatal("buildTweetRow with created_at: null should error, not panic")
+		}
+	})
+}
+
+func TestIsRetweet(t *testing.T) {
+	if !isRetweet(map[string]interface{}{"retweeted_status": map[string]interface{}{}}) {
+		t.Error("tweet with retweeted_status should be a retweet")
+	}
+	if !isRetweet(map[string]interface{}{"text": "RT @someone: hi"}) {
+		t.Error(`tweet with text starting "RT @" should be a retweet`)
+	}
+	if isRetweet(map[string]interface{}{"text": "just a tweet"}) {
+		t.Error("plain tweet should not be a retweet")
+	}
+}
+
+func TestExtractGeo(t *testing.T) {
+	lon, lat, ok := extractGeo(map[string]interface{}{
+		"coordinates": map[string]interface{}{
+			"coordinates": []interface{}{1.5, 2.5},
+		},
+	})
+	if !ok || lon != 1.5 || lat != 2.5 {
+		t.Errorf("coordinates form: got (%v, %v, %v), want (1.5, 2.5, true)", lon, lat, ok)
+	}
+
+	lon, lat, ok = extractGeo(map[string]interface{}{
+		"geo": map[string]interface{}{
+			"coordinates": []interface{}{2.5, 1.5},
+		},
+	})
+	if !ok || lon != 1.5 || lat != 2.5 {
+		t.Errorf("geo form: got (%v, %v, %v), want (1.5, 2.5, true)", lon, lat, ok)
+	}
+
+	if _, _, ok := extractGeo(map[string]interface{}{}); ok {
+		t.Error("tweet with no geo fields should report ok=false")
+	}
+}